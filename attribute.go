@@ -1,22 +1,188 @@
 package stun
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
 	"net"
+	"net/netip"
+	"strings"
+	"stun/util"
+	"sync"
+	"unicode/utf8"
 )
 
-type Attribute struct {
+// Attribute is the typed value of a STUN attribute. Encode and Decode only
+// deal with the value, the type, length and padding around it are written by
+// the message. The transactionId is passed for attributes such as
+// XOR-MAPPED-ADDRESS whose encoding depends on it.
+type Attribute interface {
+	Type() AttrType
+	// Encode appends the encoded value to b.
+	Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error)
+	// Decode parses value, it must not keep value after returning.
+	Decode(value []byte, traId [transactionIDSize]byte) error
+}
+
+// rawAttribute is an attribute as it appears in a message.
+type rawAttribute struct {
 	attrType AttrType
 	length   uint16
 	value    []byte
 }
 
-func (a *Attribute) toRaw() ([]byte, error) {
-	raw := make([]byte, 4, a.length+4)
-	bin.PutUint16(raw, uint16(a.attrType))
-	bin.PutUint16(raw[2:], a.length)
-	raw = append(raw, a.value...)
-	return raw, nil
+// appendAttribute appends the type, length and value of an attribute to b.
+func appendAttribute(b []byte, attrType AttrType, value []byte) []byte {
+	b = append(b, byte(attrType>>8), byte(attrType), byte(len(value)>>8), byte(len(value)))
+	b = append(b, value...)
+	// RFC 5389 pads values to 4 bytes without counting the padding in length
+	for i := len(value); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+func decodeAttribute(a rawAttribute, traId [transactionIDSize]byte) (Attribute, error) {
+	attr := NewAttribute(a.attrType)
+	if err := attr.Decode(a.value, traId); err != nil {
+		return nil, err
+	}
+	return attr, nil
+}
+
+// checkAttribute reports whether the value of a decodes. It does not allocate
+// for the attribute types of this package, so that decoding a message does
+// not have to.
+func checkAttribute(a rawAttribute, traId [transactionIDSize]byte) error {
+	switch a.attrType {
+	case AttrMappedAddress,
+		AttrResponseAddress,
+		AttrSourceAddress,
+		AttrChangedAddress,
+		AttrReflectedFrom,
+		AttrXorMappedAddress:
+		return checkAddress(a.value)
+	case AttrChangeRequest:
+		return checkLength(a.value, 4, errInvalidChangeRequest)
+	case AttrUsername,
+		AttrPassword,
+		AttrSoftware:
+		return nil
+	case AttrMessageIntegrity:
+		return checkLength(a.value, 20, errInvalidMessageIntegrity)
+	case AttrErrorCode:
+		if len(a.value) < 4 {
+			return errInvalidErrorCode
+		}
+		return nil
+	case AttrUnknownAttributes:
+		if len(a.value)%attrTypeSize != 0 {
+			return errInvalidUnknownAttributes
+		}
+		return nil
+	case AttrFingerprint:
+		return checkLength(a.value, 4, errInvalidFingerprint)
+	}
+	if _, ok := registeredAttribute(a.attrType); ok {
+		_, err := decodeAttribute(a, traId)
+		return err
+	}
+	return nil
+}
+func checkLength(value []byte, length int, err error) error {
+	if len(value) != length {
+		return err
+	}
+	return nil
+}
+
+var (
+	errInvalidAddress           = errors.New("invalid address")
+	errInvalidChangeRequest     = errors.New("invalid change request")
+	errInvalidMessageIntegrity  = errors.New("invalid message integrity")
+	errInvalidFingerprint       = errors.New("invalid fingerprint")
+	errInvalidErrorCode         = errors.New("invalid error code")
+	errInvalidUnknownAttributes = errors.New("invalid unknown attributes")
+)
+
+// NewAttribute returns an empty attribute of the type that decodes attrType,
+// a RawAttr for types that are neither known nor registered.
+func NewAttribute(attrType AttrType) Attribute {
+	switch attrType {
+	case AttrMappedAddress,
+		AttrResponseAddress,
+		AttrSourceAddress,
+		AttrChangedAddress,
+		AttrReflectedFrom:
+		return &AddressAttr{AttrType: attrType}
+	case AttrXorMappedAddress:
+		return &XorAddressAttr{AttrType: attrType}
+	case AttrChangeRequest:
+		return &ChangeRequestAttr{}
+	case AttrUsername,
+		AttrPassword,
+		AttrSoftware:
+		return &TextAttr{AttrType: attrType}
+	case AttrMessageIntegrity:
+		return &MessageIntegrityAttr{}
+	case AttrErrorCode:
+		return &ErrorCodeAttr{}
+	case AttrUnknownAttributes:
+		return &UnknownAttributesAttr{}
+	case AttrFingerprint:
+		return &FingerprintAttr{}
+	}
+	if r, ok := registeredAttribute(attrType); ok {
+		return r.newAttr()
+	}
+	return &RawAttr{AttrType: attrType}
+}
+
+type registration struct {
+	name    string
+	newAttr func() Attribute
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[AttrType]registration{}
+)
+
+// RegisterAttribute makes messages decode attributes of type attrType with
+// the Attribute returned by newAttr, and print them as name. The attributes a
+// message carries are then considered understood, a comprehension-required
+// one no longer ends up in UnknownComprehensionRequired. Types already known
+// to this package or registered before are rejected.
+//
+// Custom attributes are added to outgoing messages with AddAttribute.
+func RegisterAttribute(attrType AttrType, name string, newAttr func() Attribute) error {
+	if name == "" || newAttr == nil {
+		return errors.New("invalid attribute registration")
+	}
+	if attr := newAttr(); attr == nil || attr.Type() != attrType {
+		return errors.New("attribute type mismatch")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[attrType]; ok || builtinAttrTypeName(attrType) != "" {
+		return fmt.Errorf("attribute 0x%04x already registered", uint16(attrType))
+	}
+	registry[attrType] = registration{name, newAttr}
+	return nil
+}
+
+// unregisterAttribute undoes RegisterAttribute, for tests.
+func unregisterAttribute(attrType AttrType) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, attrType)
+}
+func registeredAttribute(attrType AttrType) (registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	r, ok := registry[attrType]
+	return r, ok
 }
 
 type AttrType uint16
@@ -33,9 +199,30 @@ const (
 	AttrErrorCode         AttrType = 0x0009 //
 	AttrUnknownAttributes AttrType = 0x000a //
 	AttrReflectedFrom     AttrType = 0x000b //
+	AttrXorMappedAddress  AttrType = 0x0020 // RFC 5389
+	AttrSoftware          AttrType = 0x8022 // RFC 5389
+	AttrFingerprint       AttrType = 0x8028 // RFC 5389
 )
 
+// IsComprehensionRequired reports whether an agent that does not understand
+// attrType must reject the message carrying it. Types above 0x7fff are
+// optional and may be ignored.
+func IsComprehensionRequired(attrType AttrType) bool {
+	return attrType <= 0x7fff
+}
+
+// AttrTypeName returns the name of attrType, including the ones registered
+// with RegisterAttribute, or "" if it is unknown.
 func AttrTypeName(attrType AttrType) string {
+	if name := builtinAttrTypeName(attrType); name != "" {
+		return name
+	}
+	if r, ok := registeredAttribute(attrType); ok {
+		return r.name
+	}
+	return ""
+}
+func builtinAttrTypeName(attrType AttrType) string {
 	switch attrType {
 	case AttrMappedAddress:
 		return "AttrMappedAddress"
@@ -59,74 +246,379 @@ func AttrTypeName(attrType AttrType) string {
 		return "AttrUnknownAttributes"
 	case AttrReflectedFrom:
 		return "AttrReflectedFrom"
+	case AttrXorMappedAddress:
+		return "AttrXorMappedAddress"
+	case AttrSoftware:
+		return "AttrSoftware"
+	case AttrFingerprint:
+		return "AttrFingerprint"
 	}
 	return ""
 }
 
-func address2bytes(address string) ([]byte, error) {
+type ErrorCode uint16
+
+const (
+	CodeBadRequest            ErrorCode = 400 // malformed request
+	CodeUnauthorized          ErrorCode = 401 // request did not contain MESSAGE-INTEGRITY
+	CodeUnknownAttribute      ErrorCode = 420 // comprehension-required attribute not understood
+	CodeStaleCredentials      ErrorCode = 430 // USERNAME is no longer valid
+	CodeIntegrityCheckFailure ErrorCode = 431 // MESSAGE-INTEGRITY did not match
+	CodeMissingUsername       ErrorCode = 432 // MESSAGE-INTEGRITY without USERNAME
+	CodeUseTLS                ErrorCode = 433 // Shared Secret Request not sent over TLS
+	CodeServerError           ErrorCode = 500 // temporary server error
+	CodeGlobalFailure         ErrorCode = 600 // server refuses to fulfill the request
+)
+
+func ErrorCodeReason(code ErrorCode) string {
+	switch code {
+	case CodeBadRequest:
+		return "Bad Request"
+	case CodeUnauthorized:
+		return "Unauthorized"
+	case CodeUnknownAttribute:
+		return "Unknown Attribute"
+	case CodeStaleCredentials:
+		return "Stale Credentials"
+	case CodeIntegrityCheckFailure:
+		return "Integrity Check Failure"
+	case CodeMissingUsername:
+		return "Missing Username"
+	case CodeUseTLS:
+		return "Use TLS"
+	case CodeServerError:
+		return "Server Error"
+	case CodeGlobalFailure:
+		return "Global Failure"
+	}
+	return ""
+}
+
+const (
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// AddressAttr is the value of MAPPED-ADDRESS, RESPONSE-ADDRESS,
+// SOURCE-ADDRESS, CHANGED-ADDRESS and REFLECTED-FROM: a family, a port and
+// an IPv4 or IPv6 address, 8 or 20 bytes long.
+type AddressAttr struct {
+	AttrType AttrType
+	IP       net.IP
+	Port     int
+}
+
+// newAddressAttr parses address into an attribute of type attrType.
+func newAddressAttr(attrType AttrType, address string) (*AddressAttr, error) {
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil || addr.IP == nil {
-		return nil, errors.New("invalid address")
+		return nil, errInvalidAddress
+	}
+	return &AddressAttr{attrType, addr.IP, addr.Port}, nil
+}
+func (a *AddressAttr) Type() AttrType { return a.AttrType }
+func (a *AddressAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	ip, ok := netip.AddrFromSlice(a.IP)
+	if !ok || a.Port < 0 || a.Port > math.MaxUint16 {
+		return b, errInvalidAddress
 	}
-	addressBytes := make([]byte, 8)
-	bin.PutUint16(addressBytes, uint16(0x0001))
-	port := uint16(addr.Port)
-	bin.PutUint16(addressBytes[2:], port)
-	copy(addressBytes[4:8], addr.IP[len(addr.IP)-4:len(addr.IP)])
-	return addressBytes, nil
+	return appendAddress(b, netip.AddrPortFrom(ip, uint16(a.Port)))
 }
 
-func bytes2Address(bytes []byte) string {
-	if len(bytes) < 8 {
-		return ""
+// appendAddress appends the family, port and IP of addr, IPv4-mapped IPv6
+// addresses are written as IPv4.
+func appendAddress(b []byte, addr netip.AddrPort) ([]byte, error) {
+	ip, port := addr.Addr().Unmap(), addr.Port()
+	switch {
+	case ip.Is4():
+		ip4 := ip.As4()
+		b = append(b, 0, familyIPv4, byte(port>>8), byte(port))
+		return append(b, ip4[:]...), nil
+	case ip.Is6():
+		ip6 := ip.As16()
+		b = append(b, 0, familyIPv6, byte(port>>8), byte(port))
+		return append(b, ip6[:]...), nil
 	}
-	addr := net.UDPAddr{}
-	addr.IP, addr.Port = bytes[4:8], int(bin.Uint16(bytes[2:4]))
-	return addr.String()
+	return b, errInvalidAddress
+}
+func checkAddress(value []byte) error {
+	switch {
+	case len(value) == 8 && value[1] == familyIPv4,
+		len(value) == 20 && value[1] == familyIPv6:
+		return nil
+	}
+	return errInvalidAddress
+}
+func (a *AddressAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if err := checkAddress(value); err != nil {
+		return err
+	}
+	a.IP = append(a.IP[:0], value[4:]...)
+	a.Port = int(bin.Uint16(value[2:4]))
+	return nil
+}
+func (a *AddressAttr) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: a.IP, Port: a.Port}
+}
+func (a *AddressAttr) String() string {
+	return a.UDPAddr().String()
+}
+
+// XorAddressAttr is the value of XOR-MAPPED-ADDRESS, an address encoded like
+// AddressAttr with its port and IP xor-ed with the leading bytes of the
+// RFC 5389 transactionId, i.e. the magic cookie followed by the 96 bit id.
+type XorAddressAttr struct {
+	AttrType AttrType
+	IP       net.IP
+	Port     int
 }
 
-func newAttrMappedAddress(mappedAddress string) (Attribute, error) {
-	addrBytes, err := address2bytes(mappedAddress)
+func (a *XorAddressAttr) Type() AttrType { return a.AttrType }
+func (a *XorAddressAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	start := len(b)
+	b, err := (&AddressAttr{a.AttrType, a.IP, a.Port}).Encode(b, traId)
 	if err != nil {
-		return Attribute{}, err
+		return b, err
 	}
-	return Attribute{AttrMappedAddress, uint16(8), addrBytes}, nil
+	xorAddress(b[start:], traId)
+	return b, nil
 }
-func newAttrResponseAddress(respAddress string) (Attribute, error) {
-	addrBytes, err := address2bytes(respAddress)
-	if err != nil {
-		return Attribute{}, err
+func (a *XorAddressAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	addr := AddressAttr{IP: a.IP}
+	if err := addr.Decode(value, traId); err != nil {
+		return err
 	}
-	return Attribute{AttrResponseAddress, uint16(8), addrBytes}, nil
+	a.IP, a.Port = addr.IP, addr.Port^int(bin.Uint16(traId[:2]))
+	xorAddress(a.IP, traId)
+	return nil
+}
+func (a *XorAddressAttr) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: a.IP, Port: a.Port}
+}
+func (a *XorAddressAttr) String() string {
+	return a.UDPAddr().String()
 }
-func newAttrChangeRequest(changeIp bool, changePort bool) (Attribute, error) {
+
+// xorAddress xors the port and IP of an encoded address, or a bare IP, with
+// traId. It is its own inverse.
+func xorAddress(b []byte, traId [transactionIDSize]byte) {
+	if len(b) == net.IPv4len || len(b) == net.IPv6len {
+		for i := range b {
+			b[i] ^= traId[i]
+		}
+		return
+	}
+	b[2], b[3] = b[2]^traId[0], b[3]^traId[1]
+	xorAddress(b[4:], traId)
+}
+
+// ChangeRequestAttr is the value of CHANGE-REQUEST.
+type ChangeRequestAttr struct {
+	ChangeIP   bool
+	ChangePort bool
+}
+
+func (a *ChangeRequestAttr) Type() AttrType { return AttrChangeRequest }
+func (a *ChangeRequestAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
 	value := uint8(0x00)
-	if changeIp {
+	if a.ChangeIP {
 		value = value | uint8(0x04)
 	}
-	if changePort {
+	if a.ChangePort {
 		value = value | uint8(0x02)
 	}
-	bytes := [4]byte{0, 0, 0, value}
-	return Attribute{AttrChangeRequest, uint16(4), bytes[:]}, nil
+	return append(b, 0, 0, 0, value), nil
 }
-func newAttrSourceAddress(sourceAddress string) (Attribute, error) {
-	addrBytes, err := address2bytes(sourceAddress)
-	if err != nil {
-		return Attribute{}, err
+func (a *ChangeRequestAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if err := checkLength(value, 4, errInvalidChangeRequest); err != nil {
+		return err
 	}
-	return Attribute{AttrSourceAddress, uint16(8), addrBytes}, nil
+	a.ChangeIP, a.ChangePort = value[3]&0x04 == 0x04, value[3]&0x02 == 0x02
+	return nil
 }
-func newAttrChangedAddress(changedAddress string) (Attribute, error) {
-	addrBytes, err := address2bytes(changedAddress)
-	if err != nil {
-		return Attribute{}, err
+func (a *ChangeRequestAttr) String() string {
+	return fmt.Sprintf("{changeIp:%v, changePort:%v}", a.ChangeIP, a.ChangePort)
+}
+
+// TextAttr is the value of USERNAME, PASSWORD and SOFTWARE.
+type TextAttr struct {
+	AttrType AttrType
+	Text     string
+}
+
+func (a *TextAttr) Type() AttrType { return a.AttrType }
+func (a *TextAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	if a.Text == "" {
+		return b, errors.New("invalid " + AttrTypeName(a.AttrType))
+	}
+	return append(b, a.Text...), nil
+}
+func (a *TextAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	a.Text = string(value)
+	return nil
+}
+func (a *TextAttr) String() string {
+	return a.Text
+}
+
+// MessageIntegrityAttr is the value of MESSAGE-INTEGRITY. It is computed when
+// the message is encoded, see AddIntegrityAttrAnd2Raw and VerifyIntegrity.
+type MessageIntegrityAttr struct {
+	HMAC []byte
+}
+
+func (a *MessageIntegrityAttr) Type() AttrType { return AttrMessageIntegrity }
+func (a *MessageIntegrityAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	if len(a.HMAC) != 20 {
+		return b, errInvalidMessageIntegrity
+	}
+	return append(b, a.HMAC...), nil
+}
+func (a *MessageIntegrityAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if err := checkLength(value, 20, errInvalidMessageIntegrity); err != nil {
+		return err
+	}
+	a.HMAC = append(a.HMAC[:0], value...)
+	return nil
+}
+func (a *MessageIntegrityAttr) String() string {
+	return fmt.Sprintf("%x", a.HMAC)
+}
+
+// newAttrMessageIntegrity computes the HMAC-SHA1 of raw, which must be the
+// encoded message up to the MESSAGE-INTEGRITY attribute with its header length
+// already counting that attribute. The text is zero padded to a multiple of 64
+// bytes as RFC 3489 section 11.2.8 requires, RFC 5389 dropped the padding.
+func newAttrMessageIntegrity(raw []byte, key []byte) rawAttribute {
+	text := raw
+	if r := len(raw) % 64; r != 0 && !bytes.Equal(raw[4:8], cookieBytes[:]) {
+		text = make([]byte, len(raw)+64-r)
+		copy(text, raw)
+	}
+	return rawAttribute{AttrMessageIntegrity, uint16(20), util.HmacSha1(text, key)}
+}
+
+// FingerprintAttr is the value of FINGERPRINT. It is computed when an
+// RFC 5389 message is encoded and checked when it is decoded.
+type FingerprintAttr struct {
+	CRC uint32
+}
+
+func (a *FingerprintAttr) Type() AttrType { return AttrFingerprint }
+func (a *FingerprintAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	return append(b, byte(a.CRC>>24), byte(a.CRC>>16), byte(a.CRC>>8), byte(a.CRC)), nil
+}
+func (a *FingerprintAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if err := checkLength(value, 4, errInvalidFingerprint); err != nil {
+		return err
+	}
+	a.CRC = bin.Uint32(value)
+	return nil
+}
+func (a *FingerprintAttr) String() string {
+	return fmt.Sprintf("0x%08x", a.CRC)
+}
+
+// appendFingerprint appends to b a FINGERPRINT attribute holding the CRC-32
+// of b[start:], the encoded message up to it with its header length already
+// counting it.
+func appendFingerprint(b []byte, start int) []byte {
+	var attr [fingerprintSize]byte
+	bin.PutUint16(attr[:], uint16(AttrFingerprint))
+	bin.PutUint16(attr[2:], 4)
+	bin.PutUint32(attr[4:], crc32.ChecksumIEEE(b[start:])^fingerprintXor)
+	return append(b, attr[:]...)
+}
+
+// ErrorCodeAttr is the value of ERROR-CODE: the class and number of Code
+// followed by the UTF-8 reason phrase, padded with spaces to a multiple of 4
+// bytes.
+type ErrorCodeAttr struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (a *ErrorCodeAttr) Type() AttrType { return AttrErrorCode }
+func (a *ErrorCodeAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	if a.Code < 100 || a.Code > 699 {
+		return b, errInvalidErrorCode
 	}
-	return Attribute{AttrChangedAddress, uint16(8), addrBytes}, nil
+	reason := a.Reason
+	if reason == "" {
+		reason = ErrorCodeReason(a.Code)
+	}
+	if !utf8.ValidString(reason) {
+		return b, errors.New("invalid reason phrase")
+	}
+	b = append(b, 0, 0, byte(a.Code/100), byte(a.Code%100))
+	b = append(b, reason...)
+	for i := len(reason); i%4 != 0; i++ {
+		b = append(b, ' ')
+	}
+	return b, nil
+}
+func (a *ErrorCodeAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if len(value) < 4 {
+		return errInvalidErrorCode
+	}
+	a.Code = ErrorCode(value[2]&0x07)*100 + ErrorCode(value[3])
+	a.Reason = strings.TrimRight(string(value[4:]), " ")
+	return nil
+}
+func (a *ErrorCodeAttr) String() string {
+	return fmt.Sprintf("%d %s", a.Code, a.Reason)
+}
+
+// UnknownAttributesAttr is the value of UNKNOWN-ATTRIBUTES. When the number
+// of types is odd the last one is repeated, so that the value stays a multiple
+// of 4 bytes.
+type UnknownAttributesAttr struct {
+	AttrTypes []AttrType
+}
+
+func (a *UnknownAttributesAttr) Type() AttrType { return AttrUnknownAttributes }
+func (a *UnknownAttributesAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	if len(a.AttrTypes) == 0 {
+		return b, errors.New("no unknown attributes")
+	}
+	for _, attrType := range a.AttrTypes {
+		b = append(b, byte(attrType>>8), byte(attrType))
+	}
+	if len(a.AttrTypes)%2 != 0 {
+		attrType := a.AttrTypes[len(a.AttrTypes)-1]
+		b = append(b, byte(attrType>>8), byte(attrType))
+	}
+	return b, nil
+}
+func (a *UnknownAttributesAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	if len(value)%attrTypeSize != 0 {
+		return errInvalidUnknownAttributes
+	}
+	a.AttrTypes = a.AttrTypes[:0]
+	for p := 0; p < len(value); p += attrTypeSize {
+		a.AttrTypes = append(a.AttrTypes, AttrType(bin.Uint16(value[p:])))
+	}
+	return nil
+}
+
+func (a *UnknownAttributesAttr) String() string {
+	return fmt.Sprintf("%v", a.AttrTypes)
+}
+
+// RawAttr holds the value of an attribute type this package does not know.
+type RawAttr struct {
+	AttrType AttrType
+	Value    []byte
+}
+
+func (a *RawAttr) Type() AttrType { return a.AttrType }
+func (a *RawAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	return append(b, a.Value...), nil
+}
+func (a *RawAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	a.Value = append(a.Value[:0], value...)
+	return nil
+}
+func (a *RawAttr) String() string {
+	return fmt.Sprintf("%x", a.Value)
 }
-func newAttrUsername() (Attribute, error)          { return Attribute{}, nil }
-func newAttrPassword() (Attribute, error)          { return Attribute{}, nil }
-func newAttrMessageIntegrity() (Attribute, error)  { return Attribute{}, nil }
-func newAttrErrorCode() (Attribute, error)         { return Attribute{}, nil }
-func newAttrUnknownAttributes() (Attribute, error) { return Attribute{}, nil }
-func newAttrReflectedFrom() (Attribute, error)     { return Attribute{}, nil }
@@ -0,0 +1,126 @@
+package stun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// Option sets the transaction id of a message built with Build or adds an
+// attribute to it.
+type Option func(b *builder)
+
+type builder struct {
+	traId [transactionIDSize]byte
+	attrs []Attribute
+}
+
+// Build returns a message of messageType with a random RFC 3489
+// transactionId and the attributes given by opts, in order. Attributes
+// depending on the transactionId are encoded with the one from
+// WithTransactionID wherever it appears in opts.
+//
+//	req, err := stun.Build(stun.BindingRequest,
+//		stun.WithTransactionID(stun.NewRFC5389TransactionID()),
+//		stun.WithChangeRequest(true, false))
+func Build(messageType MessageType, opts ...Option) (*Message, error) {
+	b := builder{traId: NewTransactionID()}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	m := newMessage(messageType, b.traId)
+	for _, attr := range b.attrs {
+		var err error
+		if raw, ok := attr.(*verbatimAttr); ok {
+			m.verbatim = true
+			err = m.addAttribute(&raw.RawAttr)
+		} else {
+			err = m.AddAttribute(attr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// verbatimAttr is an attribute added with WithRawAttribute.
+type verbatimAttr struct {
+	RawAttr
+}
+
+// WithRawAttribute adds an attribute of attrType with value as is. Unlike
+// WithAttribute it accepts a MESSAGE-INTEGRITY or FINGERPRINT, which are then
+// encoded where they are, before the ones the message is encoded with. It is
+// meant for crafting invalid messages.
+func WithRawAttribute(attrType AttrType, value []byte) Option {
+	return func(b *builder) { b.attrs = append(b.attrs, &verbatimAttr{RawAttr{attrType, value}}) }
+}
+
+// SetAttributeLength overwrites the length of the i-th attribute of raw, an
+// encoded message, and SetMessageLength the length in its header, leaving
+// the bytes that follow as they are. Like WithRawAttribute they are meant for
+// crafting invalid messages.
+func SetAttributeLength(raw []byte, i int, length uint16) error {
+	p := messageHeaderSize
+	for ; i > 0 && p+attrTypeSize+attrLengthSize <= len(raw); i-- {
+		p += attrTypeSize + attrLengthSize + paddedLength(int(bin.Uint16(raw[p+attrTypeSize:])))
+	}
+	if i < 0 || p+attrTypeSize+attrLengthSize > len(raw) {
+		return errors.New("no such attribute")
+	}
+	bin.PutUint16(raw[p+attrTypeSize:], length)
+	return nil
+}
+func SetMessageLength(raw []byte, length uint16) error {
+	if len(raw) < messageHeaderSize {
+		return ErrTruncated
+	}
+	bin.PutUint16(raw[messageTypeSize:], length)
+	return nil
+}
+
+// WithTransactionID sets the transactionId, use NewRFC5389TransactionID for
+// an RFC 5389 message.
+func WithTransactionID(traId [transactionIDSize]byte) Option {
+	return func(b *builder) { b.traId = traId }
+}
+
+// WithAttribute adds attr, which may be of a type registered with
+// RegisterAttribute or a RawAttr.
+func WithAttribute(attr Attribute) Option {
+	return func(b *builder) { b.attrs = append(b.attrs, attr) }
+}
+
+// WithAddress adds an address attribute of attrType, such as
+// AttrResponseAddress or AttrMappedAddress.
+func WithAddress(attrType AttrType, addr netip.AddrPort) Option {
+	ip := addr.Addr().Unmap()
+	return WithAttribute(&AddressAttr{attrType, ip.AsSlice(), int(addr.Port())})
+}
+
+// WithXorMappedAddress adds an XOR-MAPPED-ADDRESS.
+func WithXorMappedAddress(addr netip.AddrPort) Option {
+	ip := addr.Addr().Unmap()
+	return WithAttribute(&XorAddressAttr{AttrXorMappedAddress, ip.AsSlice(), int(addr.Port())})
+}
+func WithChangeRequest(changeIp, changePort bool) Option {
+	return WithAttribute(&ChangeRequestAttr{changeIp, changePort})
+}
+func WithUsername(username string) Option {
+	return WithAttribute(&TextAttr{AttrUsername, username})
+}
+func WithPassword(password string) Option {
+	return WithAttribute(&TextAttr{AttrPassword, password})
+}
+func WithSoftware(software string) Option {
+	return WithAttribute(&TextAttr{AttrSoftware, software})
+}
+
+// WithErrorCode adds an ERROR-CODE, an empty reason is replaced by
+// ErrorCodeReason(code).
+func WithErrorCode(code ErrorCode, reason string) Option {
+	return WithAttribute(&ErrorCodeAttr{code, reason})
+}
+func WithUnknownAttributes(attrTypes ...AttrType) Option {
+	return WithAttribute(&UnknownAttributesAttr{attrTypes})
+}
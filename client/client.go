@@ -2,6 +2,8 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -91,6 +93,13 @@ func NatTypeName(t NatType) string {
                                  +------>Restricted
 */
 func Detect(lAddress, rAddress string) NatType {
+	return DetectAuth(lAddress, rAddress, nil)
+}
+
+// DetectAuth is Detect with Binding Requests authenticated by credentials
+// obtained from creds. Responses without a valid MESSAGE-INTEGRITY are
+// dropped, and the credentials are refreshed when the server rejects them.
+func DetectAuth(lAddress, rAddress string, creds CredentialsFunc) NatType {
 	lAddr, err := net.ResolveUDPAddr("udp", lAddress)
 	if err != nil {
 		log.Fatal(err)
@@ -105,13 +114,13 @@ func Detect(lAddress, rAddress string) NatType {
 	}
 	defer conn.Close()
 
-	c := make(chan string)
-	defer close(c)
-	go handleResp(conn, c)
+	d := &detector{conn: conn, rAddr: rAddr, ch: make(chan stun.OutMessage), done: make(chan struct{}), creds: creds}
+	defer close(d.done)
+	go d.handleResp()
 	// test1
-	if res, mappedAddress := test1(conn, rAddr, c); res {
+	if res, mappedAddress := d.test1(); res {
 		// test2
-		if test2(conn, rAddr, c) {
+		if d.test2() {
 			return OpenInternet
 		} else {
 			return FirewallAllowsUdp
@@ -121,102 +130,253 @@ func Detect(lAddress, rAddress string) NatType {
 			return FirewallBlocksUdp
 		}
 		// test2
-		if test2(conn, rAddr, c) {
+		if d.test2() {
 			return FullConeNat
 		}
 		// test1
-		if !test12(conn, rAddr, c, mappedAddress) {
+		if !d.test12(mappedAddress) {
 			return SymmetricNat
 		}
 		// test3
-		if test3(conn, rAddr, c) {
+		if d.test3() {
 			return RestrictedConeNat
 		} else {
 			return RestrictedPortConeNat
 		}
 	}
 }
-func test1(conn *net.UDPConn, rAddr *net.UDPAddr, ch chan string) (bool, string) {
-	m, err := stun.NewBindRequest(nil, "", false, false)
-	if err != nil {
-		log.Fatal(err)
+
+// Credentials are the USERNAME and PASSWORD of a Shared Secret Response.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// CredentialsFunc returns fresh credentials.
+type CredentialsFunc func() (Credentials, error)
+
+// SharedSecret returns a CredentialsFunc that fetches credentials from the
+// TLS server at address.
+func SharedSecret(address string, config *tls.Config) CredentialsFunc {
+	return func() (Credentials, error) {
+		username, password, err := FetchSharedSecret(address, config)
+		return Credentials{username, password}, err
 	}
-	conn.WriteToUDP(m.ToRaw(), rAddr)
-	select {
-	case mappedAddress := <-ch:
-		return mappedAddress == conn.LocalAddr().String(), mappedAddress
-	case <-time.After(time.Second * timeout):
+}
+
+// maxCredentialRetries is how many times a request is resent with fresh
+// credentials after the server rejected them.
+const maxCredentialRetries = 2
+
+type detector struct {
+	conn  *net.UDPConn
+	rAddr *net.UDPAddr
+	ch    chan stun.OutMessage
+	done  chan struct{}
+	creds CredentialsFunc
+	cur   *Credentials
+	// changed is the CHANGED-ADDRESS of the first response, test I(2) is
+	// sent to it
+	changed *net.UDPAddr
+}
+
+func (d *detector) test1() (bool, string) {
+	m, ok := d.request(d.rAddr, "", false, false)
+	if !ok {
 		return false, ""
 	}
+	d.changed, _ = m.ChangedAddress()
+	mappedAddress := handleBindResp(m)
+	return mappedAddress == d.conn.LocalAddr().String(), mappedAddress
 }
-func test12(conn *net.UDPConn, rAddr *net.UDPAddr, ch chan string, address string) bool {
-	m, err := stun.NewBindRequest(nil, address, false, false)
-	if err != nil {
-		log.Fatal(err)
+func (d *detector) test12(address string) bool {
+	to := d.changed
+	if to == nil {
+		log.Printf("no CHANGED-ADDRESS in the first response, test I(2) is sent to %v", d.rAddr)
+		to = d.rAddr
 	}
-	conn.WriteToUDP(m.ToRaw(), rAddr)
-	select {
-	case mappedAddress := <-ch:
-		return mappedAddress == address
-	case <-time.After(time.Second * timeout):
+	m, ok := d.request(to, "", false, false)
+	if !ok {
 		return false
 	}
+	return handleBindResp(m) == address
 }
-func test2(conn *net.UDPConn, rAddr *net.UDPAddr, ch chan string) bool {
-	m, err := stun.NewBindRequest(nil, "", true, true)
-	if err != nil {
-		log.Fatal(err)
+func (d *detector) test2() bool {
+	_, ok := d.request(d.rAddr, "", true, true)
+	return ok
+}
+func (d *detector) test3() bool {
+	_, ok := d.request(d.rAddr, "", false, true)
+	return ok
+}
+
+// request sends a Binding Request to the server at to and waits for its
+// Binding Response.
+func (d *detector) request(to *net.UDPAddr, responseAddress string, changeIp, changePort bool) (stun.OutMessage, bool) {
+	for retry := 0; retry <= maxCredentialRetries; retry++ {
+		req, key, err := d.newBindRequest(responseAddress, changeIp, changePort)
+		if err != nil {
+			log.Printf("%v", err)
+			return nil, false
+		}
+		raw := req.ToRaw()
+		if key != nil {
+			raw = req.AddIntegrityAttrAnd2Raw(key)
+		}
+		d.conn.WriteToUDP(raw, to)
+		m, ok := d.wait(req.(stun.OutMessage).TransactionId(), key)
+		if !ok {
+			return nil, false
+		}
+		if m.MessageType() == stun.BindResp {
+			return m, true
+		}
+		if code, _, _ := m.ErrorCode(); d.creds == nil || !rejectsCredentials(code) {
+			return nil, false
+		}
+		d.cur = nil
 	}
-	conn.WriteToUDP(m.ToRaw(), rAddr)
-	select {
-	case <-ch:
+	return nil, false
+}
+
+// rejectsCredentials reports whether a server answers with code when the
+// USERNAME or MESSAGE-INTEGRITY of a request is wrong, those responses cannot
+// carry a MESSAGE-INTEGRITY of their own.
+func rejectsCredentials(code stun.ErrorCode) bool {
+	switch code {
+	case stun.CodeStaleCredentials,
+		stun.CodeIntegrityCheckFailure,
+		stun.CodeMissingUsername:
 		return true
-	case <-time.After(time.Second * timeout):
-		return false
 	}
+	return false
 }
-func test3(conn *net.UDPConn, rAddr *net.UDPAddr, ch chan string) bool {
-	m, err := stun.NewBindRequest(nil, "", false, true)
-	if err != nil {
-		log.Fatal(err)
+func (d *detector) newBindRequest(responseAddress string, changeIp, changePort bool) (stun.InMessage, []byte, error) {
+	if d.creds == nil {
+		m, err := stun.NewBindRequest(nil, responseAddress, changeIp, changePort)
+		return m, nil, err
 	}
-	conn.WriteToUDP(m.ToRaw(), rAddr)
-	select {
-	case <-ch:
-		return true
-	case <-time.After(time.Second * timeout):
-		return false
+	if d.cur == nil {
+		c, err := d.creds()
+		if err != nil {
+			return nil, nil, err
+		}
+		d.cur = &c
 	}
+	m, err := stun.NewAuthBindRequest(nil, responseAddress, changeIp, changePort, d.cur.Username)
+	return m, []byte(d.cur.Password), err
 }
 
-func handleResp(conn *net.UDPConn, c chan string) {
+// wait returns the response to the request with transaction id traId. When
+// the request was signed with key, a response is only accepted if it carries
+// a MESSAGE-INTEGRITY made with the same key, or is an error response
+// rejecting the credentials, which anyone could forge.
+func (d *detector) wait(traId [16]byte, key []byte) (stun.OutMessage, bool) {
+	deadline := time.After(time.Second * timeout)
+	for {
+		select {
+		case m := <-d.ch:
+			if m.TransactionId() != traId {
+				continue
+			}
+			if key != nil {
+				if err := m.VerifyIntegrity(key); err != nil {
+					code, _, _ := m.ErrorCode()
+					if m.MessageType() == stun.BindResp || !rejectsCredentials(code) {
+						log.Printf("drop message from server,%v", err)
+						continue
+					}
+					log.Printf("accept an unauthenticated error response %d from server", code)
+				}
+			}
+			return m, true
+		case <-deadline:
+			return nil, false
+		}
+	}
+}
+
+func (d *detector) handleResp() {
 	buf := make([]byte, 1500)
 	for {
-		n, err := conn.Read(buf)
+		n, err := d.conn.Read(buf)
 		if err != nil {
 			log.Printf("%v", err.Error())
 			return
 		}
-		if stun.IsMessage(buf[:n]) {
-			m, err := stun.ToMessage(buf[:n])
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				switch m.MessageType() {
-				case stun.BindResp:
-					c <- handleBindResp(m)
-				}
+		if !stun.IsMessage(buf[:n]) {
+			continue
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		log.Printf("receive message from server,%v", m.ToString())
+		switch m.MessageType() {
+		case stun.BindResp, stun.BindErrorResp:
+			select {
+			case d.ch <- m:
+			case <-d.done:
+				return
 			}
 		}
 	}
-
 }
 
 func handleBindResp(msg stun.OutMessage) string {
-	log.Printf("receive message from server,%v", msg.ToString())
-	av := msg.GetAttribute(stun.AttrMappedAddress)
-	mappedAddress := av.(string)
-	return mappedAddress
+	// XOR-MAPPED-ADDRESS survives NATs that rewrite addresses in payloads
+	if mappedAddress, ok := msg.XorMappedAddress(); ok {
+		return mappedAddress.String()
+	}
+	if mappedAddress, ok := msg.MappedAddress(); ok {
+		return mappedAddress.String()
+	}
+	return ""
+}
+
+// FetchSharedSecret sends a Shared Secret Request over TLS to address and
+// returns the USERNAME and PASSWORD the server issued.
+func FetchSharedSecret(address string, config *tls.Config) (username, password string, err error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second * timeout}, "tcp", address, config)
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * timeout))
+
+	req, err := stun.NewShareSecretRequest(nil)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := conn.Write(req.ToRaw()); err != nil {
+		return "", "", err
+	}
+	raw, err := stun.ReadRaw(conn)
+	if err != nil {
+		return "", "", err
+	}
+	m, err := stun.ToMessage(raw)
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("receive message from server,%v", m.ToString())
+	if m.TransactionId() != req.(stun.OutMessage).TransactionId() {
+		return "", "", errors.New("transaction id mismatch")
+	}
+	switch m.MessageType() {
+	case stun.ShareSecretResp:
+		username, _ = m.Username()
+		password, _ = m.Password()
+		if username == "" || password == "" {
+			return "", "", errors.New("no username or password in shared secret response")
+		}
+		return username, password, nil
+	case stun.ShareSecretErrorResp:
+		code, reason, _ := m.ErrorCode()
+		return "", "", fmt.Errorf("shared secret request failed: %d %s", code, reason)
+	}
+	return "", "", errors.New("unexpected shared secret response")
 }
 
 func ListenEcho(laddr, saddr string) {
@@ -2,16 +2,37 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
 	"log"
+	"math/big"
+	"net"
+	"net/netip"
 	"os"
+	"stun"
+	"stun/server"
 	"testing"
+	"time"
 )
 
+// interactive runs TestClient, which reads what is typed on stdin.
+var interactive = flag.Bool("interactive", false, "run tests reading stdin")
+
 func TestClient(t *testing.T) {
 	//natType := Detect("0.0.0.0:12345", "120.92.164.196:3478")
 	//natType := Detect("127.0.0.1:3478")
 	//fmt.Println(NatTypeName(natType))
 
+	if !*interactive {
+		t.Skip("reads stdin, run with -interactive")
+	}
 	in := bufio.NewReader(os.Stdin)
 	bytes := make([]byte, 1024)
 	for {
@@ -24,3 +45,215 @@ func TestClient(t *testing.T) {
 	}
 
 }
+
+// selfSignedConfigs returns a server config with a certificate for 127.0.0.1
+// and a client config trusting it.
+func selfSignedConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stun test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serverConfig, &tls.Config{RootCAs: pool}
+}
+
+func TestFetchSharedSecret(t *testing.T) {
+	serverConfig, clientConfig := selfSignedConfigs(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(server.Config{NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	go s.ServeSharedSecret(ln)
+
+	username, password, err := FetchSharedSecret(ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(username)%4 != 0 || len(password)%4 != 0 {
+		t.Fatalf("credentials %q/%q are not a multiple of 4 bytes", username, password)
+	}
+	other, _, err := FetchSharedSecret(ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == username {
+		t.Fatal("the same username was issued twice")
+	}
+}
+
+func TestAuthRequest(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	issued := 0
+	creds := func() (Credentials, error) {
+		issued++
+		return Credentials{fmt.Sprintf("user%04d", issued), fmt.Sprintf("pass%04d", issued)}, nil
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, err := stun.ToMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			traId := req.TransactionId()
+			if username, _ := req.Username(); username != "user0002" || req.VerifyIntegrity([]byte("pass0002")) != nil {
+				resp, _ := stun.NewBindErrorResponse(traId[:], stun.CodeStaleCredentials, "")
+				serverConn.WriteToUDP(resp.ToRaw(), addr)
+				continue
+			}
+			resp, _ := stun.NewBindResponse(traId[:], addr.String(), serverConn.LocalAddr().String(), addr.String())
+			serverConn.WriteToUDP(resp.AddIntegrityAttrAnd2Raw([]byte("forged")), addr)
+			serverConn.WriteToUDP(resp.AddIntegrityAttrAnd2Raw([]byte("pass0002")), addr)
+		}
+	}()
+
+	d := &detector{conn: conn, rAddr: serverConn.LocalAddr().(*net.UDPAddr), ch: make(chan stun.OutMessage), done: make(chan struct{}), creds: creds}
+	defer close(d.done)
+	go d.handleResp()
+	m, ok := d.request(d.rAddr, "", false, false)
+	if !ok {
+		t.Fatal("no response")
+	}
+	if m.VerifyIntegrity([]byte("pass0002")) != nil {
+		t.Fatal("accepted a forged response")
+	}
+	if handleBindResp(m) != conn.LocalAddr().String() {
+		t.Fatalf("got mapped address %s", handleBindResp(m))
+	}
+	if issued != 2 {
+		t.Fatalf("fetched credentials %d times", issued)
+	}
+}
+
+func TestChangedAddress(t *testing.T) {
+	conns, err := server.ListenGroup(netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddrPort("127.0.0.2:0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := server.New(server.Config{NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	go s.ServeGroup(conns)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	d := &detector{conn: conn, rAddr: conns[0][0].LocalAddr().(*net.UDPAddr), ch: make(chan stun.OutMessage), done: make(chan struct{})}
+	defer close(d.done)
+	go d.handleResp()
+	_, mappedAddress := d.test1()
+	if alternate := conns[1][1].LocalAddr().String(); d.changed.String() != alternate {
+		t.Fatalf("got changed address %v, want %s", d.changed, alternate)
+	}
+	// nothing answers on the primary address now
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.rAddr = dead.LocalAddr().(*net.UDPAddr)
+	dead.Close()
+	if !d.test12(mappedAddress) {
+		t.Fatal("test I(2) got no response from the changed address")
+	}
+}
+
+func TestAuthErrorResponse(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	issued := 0
+	creds := func() (Credentials, error) {
+		issued++
+		return Credentials{"user", "pass"}, nil
+	}
+	requests := 0
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req, err := stun.ToMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			requests++
+			traId := req.TransactionId()
+			// anyone can send an unsigned error response
+			forged, _ := stun.NewBindErrorResponse(traId[:], stun.CodeBadRequest, "")
+			serverConn.WriteToUDP(forged.ToRaw(), addr)
+			if requests == 1 {
+				resp, _ := stun.NewBindResponse(traId[:], addr.String(), serverConn.LocalAddr().String(), addr.String())
+				serverConn.WriteToUDP(resp.AddIntegrityAttrAnd2Raw([]byte("pass")), addr)
+				continue
+			}
+			resp, _ := stun.NewBindErrorResponse(traId[:], stun.CodeUnauthorized, "")
+			serverConn.WriteToUDP(resp.AddIntegrityAttrAnd2Raw([]byte("pass")), addr)
+		}
+	}()
+
+	d := &detector{conn: conn, rAddr: serverConn.LocalAddr().(*net.UDPAddr), ch: make(chan stun.OutMessage), done: make(chan struct{}), creds: creds}
+	defer close(d.done)
+	go d.handleResp()
+	if m, ok := d.request(d.rAddr, "", false, false); !ok || m.MessageType() != stun.BindResp {
+		t.Fatal("an unauthenticated error response was accepted")
+	}
+	// 401 is no reason to fetch credentials again
+	if _, ok := d.request(d.rAddr, "", false, false); ok {
+		t.Fatal("an error response was accepted as a success")
+	}
+	if issued != 1 {
+		t.Fatalf("fetched credentials %d times", issued)
+	}
+}
@@ -1,5 +1,5 @@
 module stun
 
-go 1.15
+go 1.18
 
 require github.com/mitchellh/gox v1.0.1 // indirect
@@ -0,0 +1,78 @@
+// Package packet builds the IP packets carrying UDP datagrams that the STUN
+// server spoofs and records.
+package packet
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	protocolUDP   = 17
+	udpHeaderSize = 8
+)
+
+var be = binary.BigEndian
+
+// AppendUDP appends an IPv4 or IPv6 packet carrying payload over UDP from src
+// to dst, with id in the IPv4 header and ttl as time to live or hop limit. An
+// IPv4 address facing an IPv6 one is mapped, unless the IPv6 one is
+// unspecified, as the local address of a wildcard socket is.
+func AppendUDP(b []byte, src, dst netip.AddrPort, payload []byte, id uint16, ttl uint8) []byte {
+	srcIP, dstIP := sameFamily(src.Addr().Unmap(), dst.Addr().Unmap())
+	start := len(b)
+	var pseudo uint32
+	if srcIP.Is4() {
+		b = append(b, 0x45, 0, 0, 0, 0, 0, 0, 0, ttl, protocolUDP, 0, 0)
+		be.PutUint16(b[start+2:], uint16(20+udpHeaderSize+len(payload)))
+		be.PutUint16(b[start+4:], id)
+		b = append(append(b, srcIP.AsSlice()...), dstIP.AsSlice()...)
+		be.PutUint16(b[start+10:], ^Checksum(0, b[start:]))
+		pseudo = uint32(Checksum(0, b[start+12:start+20]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0, 0, 0, protocolUDP, ttl)
+		be.PutUint16(b[start+4:], uint16(udpHeaderSize+len(payload)))
+		b = append(append(b, srcIP.AsSlice()...), dstIP.AsSlice()...)
+		pseudo = uint32(Checksum(0, b[start+8:start+40]))
+	}
+	udp := len(b)
+	length := uint16(udpHeaderSize + len(payload))
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	be.PutUint16(b[udp:], src.Port())
+	be.PutUint16(b[udp+2:], dst.Port())
+	be.PutUint16(b[udp+4:], length)
+	b = append(b, payload...)
+	sum := ^Checksum(pseudo+uint32(protocolUDP)+uint32(length), b[udp:])
+	if sum == 0 {
+		sum = 0xffff
+	}
+	be.PutUint16(b[udp+6:], sum)
+	return b
+}
+func sameFamily(a, b netip.Addr) (netip.Addr, netip.Addr) {
+	if a.Is4() == b.Is4() {
+		return a, b
+	}
+	switch {
+	case a.Is4() && b.IsUnspecified():
+		return a, netip.IPv4Unspecified()
+	case b.Is4() && a.IsUnspecified():
+		return netip.IPv4Unspecified(), b
+	}
+	return netip.AddrFrom16(a.As16()), netip.AddrFrom16(b.As16())
+}
+
+// Checksum adds b to the ones' complement sum, folded to 16 bits.
+func Checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(be.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
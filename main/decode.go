@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"stun"
+)
+
+// rawLine matches the packets transform logs with log.Printf("raw: %x", ...).
+var rawLine = regexp.MustCompile(`raw: ([0-9a-fA-F]+)`)
+
+// decode prints the messages given in args, or read from in when there are
+// none. Packets are hex strings, possibly inside "raw: %x" log lines, one per
+// line, or in is a single binary packet.
+func decode(args []string, in io.Reader, out io.Writer, asJSON bool) error {
+	var packets [][]byte
+	for _, arg := range args {
+		raw, ok := hexPacket(arg)
+		if !ok {
+			return fmt.Errorf("not a hex packet: %s", arg)
+		}
+		packets = append(packets, raw)
+	}
+	if len(args) == 0 {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if raw, ok := hexPacket(line); ok {
+				packets = append(packets, raw)
+			}
+		}
+		if len(packets) == 0 && len(data) > 0 {
+			packets = append(packets, data)
+		}
+	}
+	for i, raw := range packets {
+		m, err := stun.ToMessage(raw)
+		if err != nil {
+			fmt.Fprintf(out, "packet %d: %v\n%s\n", i, err, hex.Dump(raw))
+			continue
+		}
+		if asJSON {
+			b, err := json.MarshalIndent(m, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s\n", b)
+			continue
+		}
+		fmt.Fprintf(out, "%s\n", m.Dump())
+	}
+	return nil
+}
+func hexPacket(line string) ([]byte, bool) {
+	if m := rawLine.FindStringSubmatch(line); m != nil {
+		line = m[1]
+	}
+	line = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == ':' {
+			return -1
+		}
+		return r
+	}, line)
+	raw, err := hex.DecodeString(line)
+	if err != nil || len(raw) == 0 {
+		return nil, false
+	}
+	return raw, true
+}
@@ -1,32 +1,125 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
 	"stun/client"
+	"stun/pcap"
 	"stun/server"
+	"syscall"
+	"time"
 )
 
 const (
 	serverMode       = "server"
 	clientModeEchoOn = "client-echo-on"
 	clientModeEchoTo = "client-echo-to"
+	decodeMode       = "decode"
+	sendMode         = "send"
+	pcapMode         = "pcap"
 )
 
 func main() {
-	m := flag.String("m", "server", "server or client")
+	m := flag.String("m", "server", "server, client-echo-on, client-echo-to, decode, send or pcap")
 	s := flag.String("s", "127.0.0.1:3478", "server host")
 	l := flag.String("l", "127.0.0.1:12345", "local host")
 	r := flag.String("r", "127.0.0.1:12345", "endpoint host")
+	cert := flag.String("cert", "", "tls certificate file for shared secret requests")
+	key := flag.String("key", "", "tls key file for shared secret requests")
+	auth := flag.Bool("auth", false, "require message integrity on binding requests")
+	asJSON := flag.Bool("json", false, "print decoded messages as json")
+	wait := flag.Duration("wait", 2*time.Second, "how long send waits for replies")
+	record := flag.String("record", "", "pcap file the server records its traffic to")
+	recordSize := flag.Int64("record-size", 0, "start a new record file after this many bytes, 0 for no limit")
+	recordAge := flag.Duration("record-age", 0, "start a new record file after this long, 0 for no limit")
+	alt := flag.String("alt", "", "alternate server ip:port, listen on its combinations with the server host too")
+	public := flag.String("public", "", "public ip of the server host behind a 1:1 nat")
+	altPublic := flag.String("alt-public", "", "public ip of the alternate server ip behind a 1:1 nat")
+	advertise := flag.String("advertise", "", "comma separated local=public addresses of sockets behind a 1:1 nat")
+	readers := flag.Int("readers", 1, "sockets reading each server address, sharing it with SO_REUSEPORT")
+	batch := flag.Int("batch", 32, "datagrams read and responses written by one syscall, 1 for one by one")
+	slowWorkers := flag.Int("slow-workers", 1, "goroutines sending change request responses through raw sockets")
+	noRaw := flag.Bool("no-raw", false, "never spoof change request responses through raw sockets")
 	flag.Parse()
 
 	if serverMode == *m {
-		server.Serve(*s)
+		config := server.Config{
+			Addresses:              []string{*s},
+			AlternateAddress:       *alt,
+			PublicAddress:          *public,
+			AlternatePublicAddress: *altPublic,
+			RequireIntegrity:       *auth,
+			NoRawSocket:            *noRaw,
+			Readers:                *readers,
+			BatchSize:              *batch,
+			SlowPathWorkers:        *slowWorkers,
+			LogMessages:            true,
+		}
+		if *advertise != "" {
+			config.AdvertisedAddresses = map[string]string{}
+			for _, pair := range strings.Split(*advertise, ",") {
+				local, public, ok := strings.Cut(pair, "=")
+				if !ok {
+					log.Fatalf("advertised address %q is not local=public", pair)
+				}
+				config.AdvertisedAddresses[local] = public
+			}
+		}
+		if *cert != "" {
+			c, err := tls.LoadX509KeyPair(*cert, *key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{c}}
+		}
+		if *record != "" {
+			recorder, err := pcap.NewRecorder(*record, *recordSize, *recordAge)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer recorder.Close()
+			config.Recorder = recorder
+		}
+		if err := serve(config); err != nil {
+			log.Print(err)
+		}
 	} else if clientModeEchoOn == *m {
 		client.ListenEcho(*l, *s)
 	} else if clientModeEchoTo == *m {
 		client.Echo(*l, *r, *s)
+	} else if decodeMode == *m {
+		if err := decode(flag.Args(), os.Stdin, os.Stdout, *asJSON); err != nil {
+			log.Fatal(err)
+		}
+	} else if sendMode == *m {
+		if err := send(*s, flag.Args(), os.Stdin, os.Stdout, *wait, *asJSON); err != nil {
+			log.Fatal(err)
+		}
+	} else if pcapMode == *m {
+		if err := analyze(flag.Args(), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		fmt.Printf("%s", "参数不合法")
 	}
 }
+
+// serve runs the server until it fails or the process is interrupted.
+func serve(config server.Config) error {
+	srv, err := server.New(config)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.ListenAndServe(ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
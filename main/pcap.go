@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"stun/pcap"
+	"time"
+)
+
+// analyze prints the STUN transactions found in each capture file, then the
+// number answered and their round trip times.
+func analyze(files []string, out io.Writer) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no capture file given")
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		r, err := pcap.NewReader(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		report, err := pcap.Analyze(r)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		printReport(out, file, report)
+	}
+	return nil
+}
+func printReport(out io.Writer, file string, report *pcap.Report) {
+	fmt.Fprintf(out, "%s\n", file)
+	var answered int
+	var min, max, sum time.Duration
+	for _, t := range report.Transactions {
+		fmt.Fprintf(out, "%s %x %s -> %s %s", t.Sent.Format("15:04:05.000000"), t.TransactionId, t.Client, t.Server, t.Request)
+		if t.Retransmits > 0 {
+			fmt.Fprintf(out, " retransmits %d", t.Retransmits)
+		}
+		if !t.Answered() {
+			fmt.Fprintf(out, " no response\n")
+			continue
+		}
+		fmt.Fprintf(out, " %s rtt %v", t.Response, t.RTT)
+		if t.MappedAddress != "" {
+			fmt.Fprintf(out, " mapped %s", t.MappedAddress)
+		}
+		if t.ErrorCode != 0 {
+			fmt.Fprintf(out, " error %d", t.ErrorCode)
+		}
+		fmt.Fprintf(out, "\n")
+		if answered == 0 || t.RTT < min {
+			min = t.RTT
+		}
+		if t.RTT > max {
+			max = t.RTT
+		}
+		sum += t.RTT
+		answered++
+	}
+	fmt.Fprintf(out, "transactions %d, answered %d", len(report.Transactions), answered)
+	if answered > 0 {
+		fmt.Fprintf(out, ", rtt min/avg/max %v/%v/%v", min, sum/time.Duration(answered), max)
+	}
+	fmt.Fprintf(out, ", unmatched responses %d, malformed %d\n", report.UnmatchedResponses, report.Malformed)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"stun"
+	"time"
+)
+
+// craft describes a message for the send mode, for example
+//
+//	{"type": "BindReq", "rfc5389": true, "password": "secret",
+//	 "attributes": [
+//	  {"type": "AttrChangeRequest", "value": {"changeIp": true, "changePort": false}},
+//	  {"type": "AttrUsername", "value": "user"},
+//	  {"type": "AttrMappedAddress", "raw": "0003", "length": 12},
+//	  {"type": "0x7f00", "raw": ""},
+//	  {"type": "AttrMessageIntegrity", "raw": "00"}]}
+//
+// Attributes are encoded like MarshalJSON writes them, or taken verbatim
+// from raw, the only way to add a MESSAGE-INTEGRITY or FINGERPRINT. Length
+// fields can be overridden after encoding, which breaks MESSAGE-INTEGRITY
+// and FINGERPRINT as a peer would see it.
+type craft struct {
+	Type          stun.MessageType `json:"type"`
+	TransactionId string           `json:"transactionId"` // hex, random if empty
+	RFC5389       bool             `json:"rfc5389"`       // random transactionId with the magic cookie
+	Password      string           `json:"password"`      // adds MESSAGE-INTEGRITY keyed with it
+	Length        *uint16          `json:"length"`        // header length override
+	Attributes    []craftAttribute `json:"attributes"`
+}
+type craftAttribute struct {
+	Type   stun.AttrType   `json:"type"`
+	Value  json.RawMessage `json:"value"`
+	Raw    *string         `json:"raw"`    // hex value sent as is
+	Length *uint16         `json:"length"` // attribute length override
+}
+
+// encode returns the bytes described by c, built like stun.Build does.
+func (c *craft) encode() ([]byte, error) {
+	traId := stun.NewTransactionID()
+	if c.RFC5389 {
+		traId = stun.NewRFC5389TransactionID()
+	}
+	if c.TransactionId != "" {
+		b, err := hex.DecodeString(c.TransactionId)
+		if err != nil || len(b) != len(traId) {
+			return nil, errors.New("invalid transactionId")
+		}
+		copy(traId[:], b)
+	}
+	opts := []stun.Option{stun.WithTransactionID(traId)}
+	for _, a := range c.Attributes {
+		if a.Raw != nil {
+			value, err := hex.DecodeString(*a.Raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", a.Type, err)
+			}
+			opts = append(opts, stun.WithRawAttribute(a.Type, value))
+			continue
+		}
+		attr := stun.NewAttribute(a.Type)
+		if err := json.Unmarshal(a.Value, attr); err != nil {
+			return nil, fmt.Errorf("%s: %v", a.Type, err)
+		}
+		opts = append(opts, stun.WithAttribute(attr))
+	}
+	m, err := stun.Build(c.Type, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	if c.Password != "" {
+		raw = m.EncodeWithIntegrity(nil, []byte(c.Password))
+	} else {
+		raw = m.Encode(nil)
+	}
+	// lengths are overridden last, the peer sees them break what follows,
+	// from the end since SetAttributeLength walks those before i
+	for i := len(c.Attributes) - 1; i >= 0; i-- {
+		a := c.Attributes[i]
+		if a.Length == nil {
+			continue
+		}
+		if err := stun.SetAttributeLength(raw, i, *a.Length); err != nil {
+			return nil, fmt.Errorf("%s: %v", a.Type, err)
+		}
+	}
+	if c.Length != nil {
+		if err := stun.SetMessageLength(raw, *c.Length); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// send sends the message described by each of descriptions, read from in
+// when there are none, to address and prints the replies received within
+// wait.
+func send(address string, descriptions []string, in io.Reader, out io.Writer, wait time.Duration, asJSON bool) error {
+	if len(descriptions) == 0 {
+		b, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		descriptions = []string{string(b)}
+	}
+	// replies to a CHANGE-REQUEST come from other addresses, which a
+	// connected socket would drop
+	rAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, description := range descriptions {
+		var c craft
+		if err := json.Unmarshal([]byte(description), &c); err != nil {
+			return err
+		}
+		raw, err := c.encode()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "send %d bytes to %s\nraw: %x\n", len(raw), address, raw)
+		if _, err := conn.WriteToUDP(raw, rAddr); err != nil {
+			return err
+		}
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "receive %d bytes from %s\nraw: %x\n", n, from, buf[:n])
+			if err := decode([]string{hex.EncodeToString(buf[:n])}, nil, out, asJSON); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
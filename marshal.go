@@ -0,0 +1,287 @@
+package stun
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var builtinMessageTypes = []MessageType{
+	BindReq, BindResp, BindErrorResp, ShareSecretReq, ShareSecretResp, ShareSecretErrorResp,
+}
+
+var builtinAttrTypes = []AttrType{
+	AttrMappedAddress, AttrResponseAddress, AttrChangeRequest, AttrSourceAddress,
+	AttrChangedAddress, AttrUsername, AttrPassword, AttrMessageIntegrity,
+	AttrErrorCode, AttrUnknownAttributes, AttrReflectedFrom, AttrXorMappedAddress,
+	AttrSoftware, AttrFingerprint,
+}
+
+// String returns the name of t, or its value in hex if it has none.
+func (t MessageType) String() string {
+	if name := MessageTypeName(t); name != "" {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(t))
+}
+func (t MessageType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+func (t *MessageType) UnmarshalText(text []byte) error {
+	for _, messageType := range builtinMessageTypes {
+		if MessageTypeName(messageType) == string(text) {
+			*t = messageType
+			return nil
+		}
+	}
+	v, err := parseHex16(string(text))
+	if err != nil {
+		return fmt.Errorf("unknown message type %q", text)
+	}
+	*t = MessageType(v)
+	return nil
+}
+
+// String returns the name of t, or its value in hex if it has none.
+func (t AttrType) String() string {
+	return attrName(t)
+}
+func (t AttrType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+func (t *AttrType) UnmarshalText(text []byte) error {
+	for _, attrType := range builtinAttrTypes {
+		if AttrTypeName(attrType) == string(text) {
+			*t = attrType
+			return nil
+		}
+	}
+	registryMu.RLock()
+	for attrType, r := range registry {
+		if r.name == string(text) {
+			registryMu.RUnlock()
+			*t = attrType
+			return nil
+		}
+	}
+	registryMu.RUnlock()
+	v, err := parseHex16(string(text))
+	if err != nil {
+		return fmt.Errorf("unknown attribute type %q", text)
+	}
+	*t = AttrType(v)
+	return nil
+}
+func parseHex16(s string) (uint16, error) {
+	if !strings.HasPrefix(s, "0x") {
+		return 0, errors.New("no 0x prefix")
+	}
+	v, err := strconv.ParseUint(s[2:], 16, 16)
+	return uint16(v), err
+}
+
+type jsonMessage struct {
+	Type          MessageType     `json:"type"`
+	Length        uint16          `json:"length"`
+	TransactionId string          `json:"transactionId"`
+	Attributes    []jsonAttribute `json:"attributes"`
+}
+type jsonAttribute struct {
+	Type  AttrType        `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// MarshalJSON writes the header and the decoded attributes. Attributes whose
+// value does not decode are written as RawAttr, a hex string.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	j := jsonMessage{
+		Type:          m.messageType,
+		Length:        m.length,
+		TransactionId: hex.EncodeToString(m.transactionID[:]),
+		Attributes:    make([]jsonAttribute, 0, len(m.attributes)),
+	}
+	for _, a := range m.attributes {
+		attr, err := decodeAttribute(a, m.transactionID)
+		if err != nil {
+			attr = &RawAttr{a.attrType, a.value}
+		}
+		value, err := json.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		j.Attributes = append(j.Attributes, jsonAttribute{a.attrType, value})
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON reads what MarshalJSON writes. MESSAGE-INTEGRITY and
+// FINGERPRINT are left out since they are computed when the message is
+// encoded, the length is computed as well.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var j jsonMessage
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	traId, err := hex.DecodeString(j.TransactionId)
+	if err != nil || len(traId) != transactionIDSize {
+		return errors.New("invalid transactionId")
+	}
+	m.Reset(j.Type, toTransactionID(traId))
+	for _, a := range j.Attributes {
+		if a.Type == AttrMessageIntegrity || a.Type == AttrFingerprint {
+			continue
+		}
+		attr := NewAttribute(a.Type)
+		if err := json.Unmarshal(a.Value, attr); err != nil {
+			return fmt.Errorf("%s: %v", attrName(a.Type), err)
+		}
+		if err := m.addAttribute(attr); err != nil {
+			return fmt.Errorf("%s: %v", attrName(a.Type), err)
+		}
+	}
+	return nil
+}
+
+// Dump returns a multi-line description of the message, each attribute with
+// its type, length, decoded value and bytes.
+func (m *Message) Dump() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (0x%04x)\n", m.messageType, uint16(m.messageType))
+	fmt.Fprintf(&b, "    Length: %d\n", m.length)
+	fmt.Fprintf(&b, "    TransactionId: %x", m.transactionID)
+	if m.IsRFC5389() {
+		b.WriteString(" (RFC 5389 magic cookie)")
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "    Attributes: %d\n", len(m.attributes))
+	for _, a := range m.attributes {
+		fmt.Fprintf(&b, "        %s (0x%04x), length %d: ", a.attrType, uint16(a.attrType), a.length)
+		if attr, err := decodeAttribute(a, m.transactionID); err != nil {
+			fmt.Fprintf(&b, "malformed, %v\n", err)
+		} else {
+			fmt.Fprintf(&b, "%v\n", attr)
+		}
+		for _, line := range strings.SplitAfter(hex.Dump(a.value), "\n") {
+			if line != "" {
+				b.WriteString("            " + line)
+			}
+		}
+	}
+	return b.String()
+}
+
+func (a *AddressAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+func (a *AddressAttr) UnmarshalJSON(b []byte) error {
+	addr, err := unmarshalAddrPort(b)
+	if err != nil {
+		return err
+	}
+	a.IP, a.Port = addr.Addr().Unmap().AsSlice(), int(addr.Port())
+	return nil
+}
+func (a *XorAddressAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+func (a *XorAddressAttr) UnmarshalJSON(b []byte) error {
+	addr, err := unmarshalAddrPort(b)
+	if err != nil {
+		return err
+	}
+	a.IP, a.Port = addr.Addr().Unmap().AsSlice(), int(addr.Port())
+	return nil
+}
+func unmarshalAddrPort(b []byte) (netip.AddrPort, error) {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.ParseAddrPort(s)
+}
+func (a *ChangeRequestAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ChangeIP   bool `json:"changeIp"`
+		ChangePort bool `json:"changePort"`
+	}{a.ChangeIP, a.ChangePort})
+}
+func (a *ChangeRequestAttr) UnmarshalJSON(b []byte) error {
+	var v struct {
+		ChangeIP   bool `json:"changeIp"`
+		ChangePort bool `json:"changePort"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	a.ChangeIP, a.ChangePort = v.ChangeIP, v.ChangePort
+	return nil
+}
+func (a *TextAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Text)
+}
+func (a *TextAttr) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &a.Text)
+}
+func (a *MessageIntegrityAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(a.HMAC))
+}
+func (a *MessageIntegrityAttr) UnmarshalJSON(b []byte) (err error) {
+	a.HMAC, err = unmarshalHex(b)
+	return err
+}
+func (a *FingerprintAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+func (a *FingerprintAttr) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(s, "0x") {
+		return errors.New("invalid fingerprint")
+	}
+	v, err := strconv.ParseUint(s[2:], 16, 32)
+	a.CRC = uint32(v)
+	return err
+}
+func (a *ErrorCodeAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Code   ErrorCode `json:"code"`
+		Reason string    `json:"reason"`
+	}{a.Code, a.Reason})
+}
+func (a *ErrorCodeAttr) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Code   ErrorCode `json:"code"`
+		Reason string    `json:"reason"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	a.Code, a.Reason = v.Code, v.Reason
+	return nil
+}
+func (a *UnknownAttributesAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.AttrTypes)
+}
+func (a *UnknownAttributesAttr) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &a.AttrTypes)
+}
+func (a *RawAttr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(a.Value))
+}
+func (a *RawAttr) UnmarshalJSON(b []byte) (err error) {
+	a.Value, err = unmarshalHex(b)
+	return err
+}
+func unmarshalHex(b []byte) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(s)
+}
@@ -1,10 +1,16 @@
 package stun
 
 import (
+	"crypto/hmac"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"math/rand"
+	"net"
+	"net/netip"
 )
 
 var bin = binary.BigEndian
@@ -17,51 +23,247 @@ const (
 	attrTypeSize      = 2                                                       // attr type size of bytes
 	attrLengthSize    = 2                                                       // attr length size of bytes
 	integritySize     = 20 + attrTypeSize + attrLengthSize                      // message_integrity attr size of bytes
+	fingerprintSize   = 4 + attrTypeSize + attrLengthSize                       // fingerprint attr size of bytes
+	magicCookie       = 0x2112A442                                              // first 4 bytes of an RFC 5389 transactionId
+	fingerprintXor    = 0x5354554e                                              // xor-ed into the fingerprint crc
 )
 
-type message struct {
+// Software is sent in the SOFTWARE attribute of responses to RFC 5389
+// requests, an empty string leaves it out.
+var Software = "stun-rfc3489"
+
+// Message is a STUN message. The zero value is empty, it is filled by Decode
+// or Reset and the methods adding attributes, and written by Encode. Reusing
+// a Message reuses its storage, so that a server can decode and answer
+// requests without allocating.
+type Message struct {
 	messageType   MessageType
 	length        uint16 // len(Raw) not including header
 	transactionID [transactionIDSize]byte
-	attributes    []Attribute
+	attributes    []rawAttribute
+	storage       []byte // values of the attributes added to the message
+	raw           []byte // the bytes a decoded message was read from
+	// verbatim keeps the MESSAGE-INTEGRITY and FINGERPRINT attributes added
+	// with WithRawAttribute in the encoded message
+	verbatim bool
+}
+
+func newMessage(messageType MessageType, traId [transactionIDSize]byte) *Message {
+	return &Message{messageType: messageType, transactionID: traId}
 }
 
-func (m *message) TransactionId() [transactionIDSize]byte {
+// Reset empties m for building a new message, keeping its storage.
+func (m *Message) Reset(messageType MessageType, traId [transactionIDSize]byte) {
+	m.messageType, m.length, m.transactionID = messageType, 0, traId
+	m.attributes, m.storage, m.raw = m.attributes[:0], m.storage[:0], nil
+	m.verbatim = false
+}
+
+func (m *Message) TransactionId() [transactionIDSize]byte {
 	return m.transactionID
 }
 
-func (m *message) Length() uint16 {
+func (m *Message) Length() uint16 {
 	return m.length
 }
 
-func (m *message) MessageType() MessageType {
+func (m *Message) MessageType() MessageType {
 	return m.messageType
 }
 
-func (m *message) GetAttribute(attrType AttrType) interface{} {
-	for _, attribute := range m.attributes {
-		if attribute.attrType != attrType {
+// IsRFC5389 reports whether the transactionId starts with the magic cookie,
+// which tells RFC 5389 agents from RFC 3489 ones.
+func (m *Message) IsRFC5389() bool {
+	return isRFC5389(m.transactionID)
+}
+func isRFC5389(traId [transactionIDSize]byte) bool {
+	return bin.Uint32(traId[:4]) == magicCookie
+}
+
+// GetAttribute decodes the first attribute of type attrType, ok is false if
+// the message has none or its value is malformed.
+func (m *Message) GetAttribute(attrType AttrType) (Attribute, bool) {
+	for _, a := range m.attributes {
+		if a.attrType != attrType {
 			continue
 		}
-		switch attrType {
-		case AttrMappedAddress,
-			AttrResponseAddress,
-			AttrSourceAddress,
-			AttrChangedAddress:
-			return bytes2Address(attribute.value)
-		case AttrChangeRequest:
-			f := attribute.value[1]
-			return [2]bool{f^0x04 == 0x04, f^0x02 == 0x02}
-		case AttrUsername:
-		case AttrPassword:
-		case AttrMessageIntegrity:
-		case AttrErrorCode:
-		case AttrUnknownAttributes:
-		case AttrReflectedFrom:
+		attr, err := decodeAttribute(a, m.transactionID)
+		return attr, err == nil
+	}
+	return nil, false
+}
+
+// GetAttributes decodes every attribute of type attrType, skipping malformed
+// ones, for attributes that may be repeated.
+func (m *Message) GetAttributes(attrType AttrType) []Attribute {
+	var attrs []Attribute
+	for _, a := range m.attributes {
+		if a.attrType != attrType {
+			continue
+		}
+		if attr, err := decodeAttribute(a, m.transactionID); err == nil {
+			attrs = append(attrs, attr)
 		}
 	}
+	return attrs
+}
+
+// Contains reports whether the message has an attribute of type attrType.
+func (m *Message) Contains(attrType AttrType) bool {
+	_, ok := m.value(attrType)
+	return ok
+}
+func (m *Message) value(attrType AttrType) ([]byte, bool) {
+	for _, a := range m.attributes {
+		if a.attrType == attrType {
+			return a.value, true
+		}
+	}
+	return nil, false
+}
+func (m *Message) address(attrType AttrType) (*net.UDPAddr, bool) {
+	attr, ok := m.GetAttribute(attrType)
+	if !ok {
+		return nil, false
+	}
+	switch a := attr.(type) {
+	case *AddressAttr:
+		return a.UDPAddr(), true
+	case *XorAddressAttr:
+		return a.UDPAddr(), true
+	}
+	return nil, false
+}
+func (m *Message) text(attrType AttrType) (string, bool) {
+	attr, ok := m.GetAttribute(attrType)
+	if !ok {
+		return "", false
+	}
+	a, ok := attr.(*TextAttr)
+	if !ok {
+		return "", false
+	}
+	return a.Text, true
+}
+func (m *Message) MappedAddress() (*net.UDPAddr, bool) {
+	return m.address(AttrMappedAddress)
+}
+func (m *Message) XorMappedAddress() (*net.UDPAddr, bool) {
+	return m.address(AttrXorMappedAddress)
+}
+func (m *Message) ResponseAddress() (*net.UDPAddr, bool) {
+	return m.address(AttrResponseAddress)
+}
+func (m *Message) SourceAddress() (*net.UDPAddr, bool) {
+	return m.address(AttrSourceAddress)
+}
+func (m *Message) ChangedAddress() (*net.UDPAddr, bool) {
+	return m.address(AttrChangedAddress)
+}
+func (m *Message) ReflectedFrom() (*net.UDPAddr, bool) {
+	return m.address(AttrReflectedFrom)
+}
+func (m *Message) ChangeRequest() (changeIp, changePort, ok bool) {
+	var a ChangeRequestAttr
+	value, ok := m.value(AttrChangeRequest)
+	if !ok || a.Decode(value, m.transactionID) != nil {
+		return false, false, false
+	}
+	return a.ChangeIP, a.ChangePort, true
+}
+func (m *Message) Username() (string, bool) {
+	return m.text(AttrUsername)
+}
+func (m *Message) Password() (string, bool) {
+	return m.text(AttrPassword)
+}
+func (m *Message) Software() (string, bool) {
+	return m.text(AttrSoftware)
+}
+func (m *Message) ErrorCode() (code ErrorCode, reason string, ok bool) {
+	attr, ok := m.GetAttribute(AttrErrorCode)
+	if !ok {
+		return 0, "", false
+	}
+	a := attr.(*ErrorCodeAttr)
+	return a.Code, a.Reason, true
+}
+
+// UnknownAttributes returns the types listed in the UNKNOWN-ATTRIBUTES
+// attribute of a 420 error response.
+func (m *Message) UnknownAttributes() ([]AttrType, bool) {
+	attr, ok := m.GetAttribute(AttrUnknownAttributes)
+	if !ok {
+		return nil, false
+	}
+	return attr.(*UnknownAttributesAttr).AttrTypes, true
+}
+
+// UnknownComprehensionRequired returns the comprehension-required attribute
+// types of the message that this package does not understand.
+func (m *Message) UnknownComprehensionRequired() []AttrType {
+	var attrTypes []AttrType
+	for _, a := range m.attributes {
+		if AttrTypeName(a.attrType) != "" || !IsComprehensionRequired(a.attrType) {
+			continue
+		}
+		attrTypes = append(attrTypes, a.attrType)
+	}
+	return attrTypes
+}
+
+// AddAttribute encodes attr, which may be an attribute registered with
+// RegisterAttribute, and appends it to the message. MESSAGE-INTEGRITY and
+// FINGERPRINT are computed by the encoder and cannot be added.
+func (m *Message) AddAttribute(attr Attribute) error {
+	if attr.Type() == AttrMessageIntegrity || attr.Type() == AttrFingerprint {
+		return errors.New("cannot add " + AttrTypeName(attr.Type()))
+	}
+	return m.addAttribute(attr)
+}
+
+// addAttribute encodes attr and appends it to the message.
+func (m *Message) addAttribute(attr Attribute) error {
+	start := len(m.storage)
+	storage, err := attr.Encode(m.storage, m.transactionID)
+	if err != nil {
+		return err
+	}
+	m.storage = storage
+	return m.addEncoded(attr.Type(), start)
+}
+
+// addEncoded appends an attribute of type attrType whose value was encoded
+// at m.storage[start:].
+func (m *Message) addEncoded(attrType AttrType, start int) error {
+	end := len(m.storage)
+	if end-start > math.MaxUint16 {
+		m.storage = m.storage[:start]
+		return errors.New(attrName(attrType) + " too long")
+	}
+	m.attributes = append(m.attributes, rawAttribute{attrType, uint16(end - start), m.storage[start:end:end]})
+	m.sumLength()
 	return nil
 }
+func (m *Message) addAddress(attrType AttrType, addr netip.AddrPort) error {
+	start := len(m.storage)
+	storage, err := appendAddress(m.storage, addr)
+	if err != nil {
+		return err
+	}
+	m.storage = storage
+	return m.addEncoded(attrType, start)
+}
+
+// Errors returned by ToMessage, attribute decoding errors are wrapped in
+// ErrBadAttribute.
+var (
+	ErrBadMessageType      = errors.New("invalid message type")
+	ErrTruncated           = errors.New("message truncated")
+	ErrBadLength           = errors.New("invalid message length")
+	ErrBadAttribute        = errors.New("invalid attribute")
+	ErrFingerprintMismatch = errors.New("fingerprint mismatch")
+)
 
 func IsMessage(bytes []byte) bool {
 	if _, err := detectMessageType(bytes); err != nil {
@@ -71,7 +273,7 @@ func IsMessage(bytes []byte) bool {
 }
 func detectMessageType(bytes []byte) (MessageType, error) {
 	if len(bytes) < messageTypeSize {
-		return 0, errors.New("no message header")
+		return 0, ErrTruncated
 	}
 	messageType := MessageType(bin.Uint16(bytes[:messageTypeSize]))
 	if messageType != BindReq &&
@@ -80,79 +282,239 @@ func detectMessageType(bytes []byte) (MessageType, error) {
 		messageType != ShareSecretReq &&
 		messageType != ShareSecretResp &&
 		messageType != ShareSecretErrorResp {
-		return 0, errors.New("invalid message header")
+		return 0, ErrBadMessageType
 	}
 	return messageType, nil
 }
+
+// ReadRaw reads one message from a stream such as the TLS connection used for
+// Shared Secret Requests, using the header length to find where it ends.
+func ReadRaw(r io.Reader) ([]byte, error) {
+	raw := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	if _, err := detectMessageType(raw); err != nil {
+		return nil, err
+	}
+	length := int(bin.Uint16(raw[messageTypeSize:]))
+	raw = append(raw, make([]byte, length)...)
+	if _, err := io.ReadFull(r, raw[messageHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// ToMessage decodes a copy of bytes, see Decode.
 func ToMessage(bytes []byte) (OutMessage, error) {
-	messageType, err := detectMessageType(bytes)
-	if err != nil {
+	m := &Message{}
+	if err := m.Decode(append([]byte(nil), bytes...)); err != nil {
 		return nil, err
 	}
-	m := message{}
-	m.messageType = messageType
+	return m, nil
+}
 
-	p := messageTypeSize
-	m.length = bin.Uint16(bytes[p : p+messageLengthSize])
-	p += messageLengthSize
+// Decode parses a whole message from buf into m, reusing the storage of m.
+// The attribute values are sub-slices of buf, which must not be modified
+// while m is in use. The header length must match the payload exactly and be
+// a multiple of 4, every attribute must fit in it with its padding, and the
+// values of the attributes this package knows, or that were registered, must
+// decode. For RFC 5389 messages FINGERPRINT is checked and must come last.
+func (m *Message) Decode(buf []byte) error {
+	messageType, err := detectMessageType(buf)
+	if err != nil {
+		return err
+	}
+	if len(buf) < messageHeaderSize {
+		return ErrTruncated
+	}
+	var traId [transactionIDSize]byte
+	copy(traId[:], buf[messageTypeSize+messageLengthSize:])
+	m.Reset(messageType, traId)
 
-	copy(m.transactionID[:], bytes[p:p+transactionIDSize])
-	p += transactionIDSize
+	p := messageTypeSize
+	m.length = bin.Uint16(buf[p : p+messageLengthSize])
+	p += messageLengthSize + transactionIDSize
+	switch end := messageHeaderSize + int(m.length); {
+	case len(buf) < end:
+		return ErrTruncated
+	case len(buf) > end, m.length%4 != 0:
+		return ErrBadLength
+	}
 
-	attributes := make([]Attribute, 0, 8)
-	for len(bytes) > p+attrTypeSize {
-		attrType := AttrType(bin.Uint16(bytes[p : p+attrTypeSize]))
+	for p < len(buf) {
+		attrType := AttrType(bin.Uint16(buf[p : p+attrTypeSize]))
 		p += attrTypeSize
 
-		if attrType > AttrReflectedFrom {
-			break
-		}
-		attrLength := bin.Uint16(bytes[p : p+attrLengthSize])
+		attrLength := bin.Uint16(buf[p : p+attrLengthSize])
 		p += attrLengthSize
+		if len(buf) < p+paddedLength(int(attrLength)) {
+			return fmt.Errorf("%w: %s exceeds message", ErrBadLength, attrName(attrType))
+		}
 
-		attrValue := make([]byte, attrLength)
-		copy(attrValue, bytes[p:p+int(attrLength)])
-		p += int(attrLength)
+		if m.IsRFC5389() && len(m.attributes) > 0 && m.attributes[len(m.attributes)-1].attrType == AttrFingerprint {
+			return fmt.Errorf("%w: %s after fingerprint", ErrBadAttribute, attrName(attrType))
+		}
 
-		attributes = append(attributes, Attribute{attrType: attrType, length: attrLength, value: attrValue})
+		a := rawAttribute{attrType, attrLength, buf[p : p+int(attrLength) : p+int(attrLength)]}
+		if err := checkAttribute(a, m.transactionID); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrBadAttribute, attrName(attrType), err)
+		}
+		// the layout of the fingerprint is checked before its value
+		if attrType == AttrFingerprint && m.IsRFC5389() && !checkFingerprint(buf[:p+int(attrLength)]) {
+			return ErrFingerprintMismatch
+		}
+		m.attributes = append(m.attributes, a)
+		p += paddedLength(int(attrLength))
 	}
-	m.attributes = attributes
-	return &m, nil
+	m.raw = buf
+	return nil
 }
-func (m *message) ToRaw() []byte {
+
+// attrName is AttrTypeName falling back to the hex type for unknown ones.
+func attrName(attrType AttrType) string {
+	if name := AttrTypeName(attrType); name != "" {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(attrType))
+}
+
+// checkFingerprint verifies raw, a message ending with its FINGERPRINT value.
+func checkFingerprint(raw []byte) bool {
+	if len(raw) < fingerprintSize+messageHeaderSize {
+		return false
+	}
+	length := uint16(len(raw) - messageHeaderSize)
+	crc := crc32.ChecksumIEEE(raw[:messageTypeSize])
+	crc = crc32UpdateByte(crc32UpdateByte(crc, byte(length>>8)), byte(length))
+	crc = crc32.Update(crc, crc32.IEEETable, raw[messageTypeSize+messageLengthSize:len(raw)-fingerprintSize])
+	return bin.Uint32(raw[len(raw)-4:]) == crc^fingerprintXor
+}
+
+// crc32UpdateByte is crc32.Update for a single byte, a slice holding it would
+// escape to the heap.
+func crc32UpdateByte(crc uint32, b byte) uint32 {
+	crc = ^crc
+	crc = crc32.IEEETable[byte(crc)^b] ^ crc>>8
+	return ^crc
+}
+
+var cookieBytes = [4]byte{0x21, 0x12, 0xA4, 0x42}
+
+// paddedLength rounds an attribute value length up to a multiple of 4.
+func paddedLength(length int) int {
+	return (length + 3) &^ 3
+}
+func (m *Message) ToRaw() []byte {
+	m.sumLength()
+	return m.encode(make([]byte, 0, messageHeaderSize+int(m.length)+integritySize+fingerprintSize), nil)
+}
+
+// AddIntegrityAttrAnd2Raw encodes the message followed by a MESSAGE-INTEGRITY
+// attribute keyed with key. The attribute is not kept in m.attributes, so the
+// message can be signed again with another key.
+func (m *Message) AddIntegrityAttrAnd2Raw(key []byte) []byte {
+	m.sumLength()
+	return m.encode(make([]byte, 0, messageHeaderSize+int(m.length)+integritySize+fingerprintSize), key)
+}
+
+// Encode appends the encoded message to buf, like ToRaw.
+func (m *Message) Encode(buf []byte) []byte {
+	return m.encode(buf, nil)
+}
+
+// EncodeWithIntegrity appends the encoded message to buf, like
+// AddIntegrityAttrAnd2Raw. Computing the HMAC allocates.
+func (m *Message) EncodeWithIntegrity(buf []byte, key []byte) []byte {
+	return m.encode(buf, key)
+}
+
+// encode appends the header and attributes to buf, then MESSAGE-INTEGRITY
+// when key is not nil and FINGERPRINT for RFC 5389 messages. Both are
+// computed over the preceding bytes with the header length already counting
+// them, so any old ones in m.attributes are left out.
+func (m *Message) encode(buf []byte, key []byte) []byte {
 	m.sumLength()
-	raw := make([]byte, 4, messageHeaderSize+m.length)
-	bin.PutUint16(raw, uint16(m.messageType))
-	bin.PutUint16(raw[2:], m.length)
-	raw = append(raw, m.transactionID[:]...)
+	start := len(buf)
+	buf = append(buf, byte(m.messageType>>8), byte(m.messageType), byte(m.length>>8), byte(m.length))
+	buf = append(buf, m.transactionID[:]...)
 	for _, a := range m.attributes {
-		attrBytes, err := a.toRaw()
-		if err != nil {
-			fmt.Printf("%e", err)
+		if m.recomputed(a) {
 			continue
 		}
-		raw = append(raw, attrBytes...)
+		buf = appendAttribute(buf, a.attrType, a.value)
+	}
+	if key != nil {
+		bin.PutUint16(buf[start+messageTypeSize:], uint16(len(buf)-start-messageHeaderSize+integritySize))
+		attr := newAttrMessageIntegrity(buf[start:], key)
+		buf = appendAttribute(buf, attr.attrType, attr.value)
+	}
+	if m.IsRFC5389() {
+		bin.PutUint16(buf[start+messageTypeSize:], uint16(len(buf)-start-messageHeaderSize+fingerprintSize))
+		buf = appendFingerprint(buf, start)
 	}
-	return raw
+	return buf
 }
-func (m *message) AddIntegrityAttrAnd2Raw() []byte {
-	raw := m.ToRaw()
-	// todo AddIntegrity
-	return raw
+
+var (
+	errNoIntegrity       = errors.New("no message integrity")
+	errIntegrityMismatch = errors.New("message integrity mismatch")
+)
+
+// VerifyIntegrity checks the MESSAGE-INTEGRITY attribute of a decoded message
+// against key. Attributes following MESSAGE-INTEGRITY are not covered.
+func (m *Message) VerifyIntegrity(key []byte) error {
+	p := messageHeaderSize
+	for _, a := range m.attributes {
+		if a.attrType != AttrMessageIntegrity {
+			p += attrTypeSize + attrLengthSize + paddedLength(int(a.length))
+			continue
+		}
+		if p > len(m.raw) {
+			return errNoIntegrity
+		}
+		text := make([]byte, p)
+		copy(text, m.raw[:p])
+		bin.PutUint16(text[messageTypeSize:], uint16(p-messageHeaderSize+integritySize))
+		expected := newAttrMessageIntegrity(text, key)
+		if !hmac.Equal(a.value, expected.value) {
+			return errIntegrityMismatch
+		}
+		return nil
+	}
+	return errNoIntegrity
 }
-func (m *message) sumLength() {
+func (m *Message) sumLength() {
 	m.length = 0
 	for _, a := range m.attributes {
-		m.length += attrTypeSize + attrLengthSize + a.length
+		if m.recomputed(a) {
+			continue
+		}
+		m.length += attrTypeSize + attrLengthSize + uint16(paddedLength(int(a.length)))
 	}
-	//m.length = m.length + integritySize
 }
-func (m *message) ToString() string {
+
+// recomputed reports whether a is left out of the encoded message, because
+// encode appends a fresh one.
+func (m *Message) recomputed(a rawAttribute) bool {
+	return !m.verbatim && (a.attrType == AttrMessageIntegrity || a.attrType == AttrFingerprint)
+}
+func (m *Message) ToString() string {
 	t := fmt.Sprintf("%x%x", bin.Uint64(m.transactionID[:8]), bin.Uint64(m.transactionID[8:]))
 	str := fmt.Sprintf("message: {messageType:%s, length:%d, transactionId: %s, attributes: [",
 		MessageTypeName(m.messageType), m.length, t)
 	for _, a := range m.attributes {
-		str += fmt.Sprintf(AttrTypeName(a.attrType)+": %v,", m.GetAttribute(a.attrType))
+		name := AttrTypeName(a.attrType)
+		if name == "" {
+			str += fmt.Sprintf("0x%04x: %x,", uint16(a.attrType), a.value)
+			continue
+		}
+		attr, err := decodeAttribute(a, m.transactionID)
+		if err != nil {
+			str += fmt.Sprintf(name+": malformed %x,", a.value)
+			continue
+		}
+		str += fmt.Sprintf(name+": %v,", attr)
 	}
 	if len(m.attributes) > 0 {
 		str = str[:len(str)-1]
@@ -170,6 +532,16 @@ const (
 	ShareSecretErrorResp MessageType = 0x0112 //共享私密错误响应
 )
 
+// The message types under their RFC 3489 names.
+const (
+	BindingRequest            = BindReq
+	BindingResponse           = BindResp
+	BindingErrorResponse      = BindErrorResp
+	SharedSecretRequest       = ShareSecretReq
+	SharedSecretResponse      = ShareSecretResp
+	SharedSecretErrorResponse = ShareSecretErrorResp
+)
+
 func MessageTypeName(messageType MessageType) string {
 	switch messageType {
 	case BindReq:
@@ -191,83 +563,147 @@ func MessageTypeName(messageType MessageType) string {
 type MessageType uint16
 
 func NewBindRequest(transactionID []byte, responseAddress string, changeIp, changePort bool) (InMessage, error) {
-	var traId [transactionIDSize]byte
-	if transactionID == nil || len(transactionID) != transactionIDSize {
-		traId = NewTransactionID()
-	} else {
-		copy(traId[:], transactionID)
-	}
-	attributes := make([]Attribute, 0, 2)
-	if changeIp {
-		addressAttr, err := newAttrResponseAddress(responseAddress)
-		if err == nil {
-			attributes = append(attributes, addressAttr)
+	opts := []Option{WithTransactionID(toTransactionID(transactionID))}
+	if responseAddress != "" {
+		if addressAttr, err := newAddressAttr(AttrResponseAddress, responseAddress); err == nil {
+			opts = append(opts, WithAttribute(addressAttr))
 		}
 	}
 	if changeIp || changePort {
-		changeReqAttr, err := newAttrChangeRequest(changeIp, changePort)
+		opts = append(opts, WithChangeRequest(changeIp, changePort))
+	}
+	return build(BindReq, opts...)
+}
+
+// NewAuthBindRequest is NewBindRequest with a USERNAME attribute, the request
+// must then be encoded with AddIntegrityAttrAnd2Raw keyed with the PASSWORD.
+func NewAuthBindRequest(transactionID []byte, responseAddress string, changeIp, changePort bool, username string) (InMessage, error) {
+	req, err := NewBindRequest(transactionID, responseAddress, changeIp, changePort)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.AddAttribute(&TextAttr{AttrUsername, username}); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+func NewBindResponse(transactionID []byte, mappedAddress, sourceAddress, changedAddress string) (InMessage, error) {
+	var addrs [3]netip.AddrPort
+	for i, address := range []string{mappedAddress, sourceAddress, changedAddress} {
+		addr, err := newAddressAttr(AttrMappedAddress, address)
 		if err != nil {
-			fmt.Errorf("%e", err)
-		} else {
-			attributes = append(attributes, changeReqAttr)
+			return nil, err
 		}
+		addrs[i] = addr.UDPAddr().AddrPort()
+	}
+	message := &Message{}
+	if err := message.SetBindResponse(toTransactionID(transactionID), addrs[0], addrs[1], addrs[2]); err != nil {
+		return nil, err
 	}
-	message := message{BindReq, uint16(0), traId, attributes}
-	message.sumLength()
-	return &message, nil
+	return message, nil
 }
-func NewBindResponse(transactionID []byte, mappedAddress, sourceAddress, changedAddress string) (InMessage, error) {
-	var traId [transactionIDSize]byte
-	if transactionID == nil || len(transactionID) != transactionIDSize {
-		traId = NewTransactionID()
-	} else {
-		copy(traId[:], transactionID)
+
+// SetBindResponse makes m the Binding Response NewBindResponse returns,
+// without allocating once m has grown its storage.
+func (m *Message) SetBindResponse(traId [transactionIDSize]byte, mapped, source, changed netip.AddrPort) error {
+	m.Reset(BindResp, traId)
+	if err := m.addAddress(AttrMappedAddress, mapped); err != nil {
+		return err
+	}
+	if err := m.addAddress(AttrSourceAddress, source); err != nil {
+		return err
+	}
+	if err := m.addAddress(AttrChangedAddress, changed); err != nil {
+		return err
+	}
+	if m.IsRFC5389() {
+		start := len(m.storage)
+		m.storage, _ = appendAddress(m.storage, mapped)
+		xorAddress(m.storage[start:], traId)
+		if err := m.addEncoded(AttrXorMappedAddress, start); err != nil {
+			return err
+		}
+		if Software != "" {
+			start = len(m.storage)
+			m.storage = append(m.storage, Software...)
+			if err := m.addEncoded(AttrSoftware, start); err != nil {
+				return err
+			}
+		}
 	}
-	attributes := make([]Attribute, 0, 4)
+	return nil
+}
 
-	mappedAddressAttr, err := newAttrMappedAddress(mappedAddress)
+// NewReflectedBindResponse is NewBindResponse for a request that asked for
+// the response to be sent to its RESPONSE-ADDRESS, reflectedFrom is the
+// address the request came from.
+func NewReflectedBindResponse(transactionID []byte, mappedAddress, sourceAddress, changedAddress, reflectedFrom string) (InMessage, error) {
+	resp, err := NewBindResponse(transactionID, mappedAddress, sourceAddress, changedAddress)
 	if err != nil {
-		fmt.Errorf("%e", err)
 		return nil, err
-	} else {
-		attributes = append(attributes, mappedAddressAttr)
 	}
-
-	sourceAddressAttr, err := newAttrSourceAddress(sourceAddress)
+	reflectedFromAttr, err := newAddressAttr(AttrReflectedFrom, reflectedFrom)
 	if err != nil {
-		fmt.Errorf("%e", err)
 		return nil, err
-	} else {
-		attributes = append(attributes, sourceAddressAttr)
 	}
-
-	changedAddressAttr, err := newAttrChangedAddress(changedAddress)
-	if err != nil {
-		fmt.Errorf("%e", err)
+	m := resp.(*Message)
+	if err := m.addAttribute(reflectedFromAttr); err != nil {
 		return nil, err
-	} else {
-		attributes = append(attributes, changedAddressAttr)
 	}
+	return m, nil
+}
+func NewBindErrorResponse(transactionID []byte, code ErrorCode, reason string) (InMessage, error) {
+	return newErrorResponse(BindErrorResp, transactionID, code, reason)
+}
+func NewShareSecretRequest(transactionID []byte) (InMessage, error) {
+	return build(ShareSecretReq, WithTransactionID(toTransactionID(transactionID)))
+}
+func NewShareSecretResponse(transactionID []byte, username, password string) (InMessage, error) {
+	return build(ShareSecretResp,
+		WithTransactionID(toTransactionID(transactionID)),
+		WithUsername(username),
+		WithPassword(password))
+}
+func NewShareSecretErrorResponse(transactionID []byte, code ErrorCode, reason string) (InMessage, error) {
+	return newErrorResponse(ShareSecretErrorResp, transactionID, code, reason)
+}
 
-	message := message{BindResp, uint16(0), traId, attributes}
-	message.sumLength()
-	return &message, nil
+// NewBindUnknownAttributesResponse returns a 420 Binding Error Response
+// listing the attribute types the server did not understand.
+func NewBindUnknownAttributesResponse(transactionID []byte, attrTypes []AttrType) (InMessage, error) {
+	return newErrorResponse(BindErrorResp, transactionID, CodeUnknownAttribute, "", &UnknownAttributesAttr{attrTypes})
 }
-func NewBindErrorResponse() (InMessage, error) {
-	message := message{}
-	return &message, nil
+
+// NewShareSecretUnknownAttributesResponse is the Shared Secret counterpart of
+// NewBindUnknownAttributesResponse.
+func NewShareSecretUnknownAttributesResponse(transactionID []byte, attrTypes []AttrType) (InMessage, error) {
+	return newErrorResponse(ShareSecretErrorResp, transactionID, CodeUnknownAttribute, "", &UnknownAttributesAttr{attrTypes})
 }
-func NewShareSecretRequest() (InMessage, error) {
-	message := message{}
-	return &message, nil
+func newErrorResponse(messageType MessageType, transactionID []byte, code ErrorCode, reason string, attrs ...Attribute) (InMessage, error) {
+	opts := []Option{WithTransactionID(toTransactionID(transactionID)), WithErrorCode(code, reason)}
+	for _, attr := range attrs {
+		opts = append(opts, WithAttribute(attr))
+	}
+	return build(messageType, opts...)
 }
-func NewShareSecretResponse() (InMessage, error) {
-	message := message{}
-	return &message, nil
+
+// build is Build returning a nil InMessage on error.
+func build(messageType MessageType, opts ...Option) (InMessage, error) {
+	m, err := Build(messageType, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
 }
-func NewShareSecretErrorResponse() (InMessage, error) {
-	message := message{}
-	return &message, nil
+
+// toTransactionID copies transactionID, or returns a new one if it does not
+// have the right size.
+func toTransactionID(transactionID []byte) (traId [transactionIDSize]byte) {
+	if len(transactionID) != transactionIDSize {
+		return NewTransactionID()
+	}
+	copy(traId[:], transactionID)
+	return traId
 }
 
 // NewTransactionID returns new random transaction ID using math/rand
@@ -278,17 +714,46 @@ func NewTransactionID() (b [transactionIDSize]byte) {
 	return b
 }
 
+// NewRFC5389TransactionID returns the magic cookie followed by a random
+// 96 bit transaction ID, messages built with it use the RFC 5389 format.
+func NewRFC5389TransactionID() (b [transactionIDSize]byte) {
+	rand.Read(b[4:])
+	copy(b[:4], cookieBytes[:])
+	return b
+}
+
 type (
 	InMessage interface {
+		AddAttribute(attr Attribute) error
 		ToRaw() []byte
-		AddIntegrityAttrAnd2Raw() []byte
+		AddIntegrityAttrAnd2Raw(key []byte) []byte
+		Encode(buf []byte) []byte
+		EncodeWithIntegrity(buf []byte, key []byte) []byte
 		ToString() string
 	}
 	OutMessage interface {
 		TransactionId() [transactionIDSize]byte
 		Length() uint16
 		MessageType() MessageType
-		GetAttribute(attrType AttrType) interface{}
+		Contains(attrType AttrType) bool
+		GetAttribute(attrType AttrType) (Attribute, bool)
+		GetAttributes(attrType AttrType) []Attribute
+		MappedAddress() (*net.UDPAddr, bool)
+		XorMappedAddress() (*net.UDPAddr, bool)
+		ResponseAddress() (*net.UDPAddr, bool)
+		SourceAddress() (*net.UDPAddr, bool)
+		ChangedAddress() (*net.UDPAddr, bool)
+		ReflectedFrom() (*net.UDPAddr, bool)
+		ChangeRequest() (changeIp, changePort, ok bool)
+		Username() (string, bool)
+		Password() (string, bool)
+		Software() (string, bool)
+		ErrorCode() (code ErrorCode, reason string, ok bool)
+		UnknownAttributes() ([]AttrType, bool)
+		UnknownComprehensionRequired() []AttrType
+		IsRFC5389() bool
+		VerifyIntegrity(key []byte) error
 		ToString() string
+		Dump() string
 	}
 )
@@ -1,8 +1,16 @@
 package stun
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +22,591 @@ func TestToMessage(t *testing.T) {
 	}
 	ToMessage(raw)
 }
+
+func TestIntegrity(t *testing.T) {
+	key := []byte("secret")
+	req, err := NewBindRequest(nil, "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := req.AddIntegrityAttrAnd2Raw(key)
+	if int(bin.Uint16(raw[2:4])) != len(raw)-messageHeaderSize {
+		t.Fatalf("length field %d, want %d", bin.Uint16(raw[2:4]), len(raw)-messageHeaderSize)
+	}
+	m, err := ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIntegrity(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIntegrity([]byte("other")); err == nil {
+		t.Fatal("verified with a wrong key")
+	}
+
+	raw[len(raw)-integritySize-1] ^= 0x01
+	m, err = ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIntegrity(key); err == nil {
+		t.Fatal("verified a tampered message")
+	}
+
+	m, err = ToMessage(req.ToRaw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyIntegrity(key); err == nil {
+		t.Fatal("verified a message without integrity")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	resp, err := NewBindErrorResponse(nil, CodeIntegrityCheckFailure, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := resp.ToRaw()
+	if len(raw)%4 != 0 {
+		t.Fatalf("error response of %d bytes is not padded", len(raw))
+	}
+	m, err := ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, reason, _ := m.ErrorCode()
+	if code != CodeIntegrityCheckFailure || reason != "Integrity Check Failure" {
+		t.Fatalf("got %d %q", code, reason)
+	}
+	if _, err := NewBindErrorResponse(nil, ErrorCode(99), ""); err == nil {
+		t.Fatal("accepted an invalid error code")
+	}
+}
+
+func TestUnknownAttributes(t *testing.T) {
+	req, err := NewBindRequest(nil, "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := req.ToRaw()
+	raw = append(raw, 0x80, 0x99, 0x00, 0x04, 0, 0, 0, 0) // optional
+	raw = append(raw, 0x00, 0x77, 0x00, 0x00)             // comprehension-required
+	bin.PutUint16(raw[2:], uint16(len(raw)-messageHeaderSize))
+	m, err := ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, changePort, ok := m.ChangeRequest(); !ok || !changePort {
+		t.Fatal("lost known attribute")
+	}
+	unknown := m.UnknownComprehensionRequired()
+	if len(unknown) != 1 || unknown[0] != 0x0077 {
+		t.Fatalf("got unknown attributes %v", unknown)
+	}
+}
+
+func TestRFC5389(t *testing.T) {
+	// sample IPv4 response from RFC 5769 section 2.2
+	raw, err := hex.DecodeString("0101003c2112a442b7e7a701bc34d686fa87dfae" +
+		"8022000b7465737420766563746f7220" +
+		"002000080001a147e112a643" +
+		"000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+		"80280004c07d4c96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsRFC5389() {
+		t.Fatal("magic cookie not detected")
+	}
+	if addr, _ := m.XorMappedAddress(); addr.String() != "192.0.2.1:32853" {
+		t.Fatalf("got xor mapped address %v", addr)
+	}
+	if software, _ := m.Software(); software != "test vector" {
+		t.Fatalf("got software %q", software)
+	}
+	if err := m.VerifyIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")); err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0x01
+	if _, err := ToMessage(raw); err == nil {
+		t.Fatal("accepted a wrong fingerprint")
+	}
+
+	traId := NewRFC5389TransactionID()
+	resp, err := NewBindResponse(traId[:], "192.0.2.1:32853", "192.0.2.2:3478", "192.0.2.3:3479")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = ToMessage(resp.AddIntegrityAttrAnd2Raw([]byte("key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.GetAttribute(AttrFingerprint); !ok {
+		t.Fatal("no fingerprint")
+	}
+	if addr, _ := m.XorMappedAddress(); addr.String() != "192.0.2.1:32853" {
+		t.Fatalf("got xor mapped address %v", addr)
+	}
+	if err := m.VerifyIntegrity([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPv6Address(t *testing.T) {
+	// sample IPv6 response from RFC 5769 section 2.3
+	raw, err := hex.DecodeString("010100482112a442b7e7a701bc34d686fa87dfae" +
+		"8022000b7465737420766563746f7220" +
+		"002000140002a1470113a9faa5d3f179bc25f4b5bed2b9d9" +
+		"00080014a382954e4be67bf11784c97c8292c275bfe3ed41" +
+		"80280004c8fb0b4c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ToMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := m.XorMappedAddress(); addr.String() != "[2001:db8:1234:5678:11:2233:4455:6677]:32853" {
+		t.Fatalf("got xor mapped address %v", addr)
+	}
+	if err := m.VerifyIntegrity([]byte("VOkJxbRl1RmTxUk/WvJxBt")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewBindResponse(nil, "[2001:db8::1]:3478", "[2001:db8::2]:3478", "192.0.2.3:3479")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = ToMessage(resp.ToRaw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attrType, want := range map[AttrType]string{
+		AttrMappedAddress:  "[2001:db8::1]:3478",
+		AttrSourceAddress:  "[2001:db8::2]:3478",
+		AttrChangedAddress: "192.0.2.3:3479",
+	} {
+		attr, _ := m.GetAttribute(attrType)
+		if addr, _ := attr.(*AddressAttr); addr.String() != want {
+			t.Fatalf("got %s %v, want %s", AttrTypeName(attrType), addr, want)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	traId := NewRFC5389TransactionID()
+	attrs := []Attribute{
+		&AddressAttr{AttrMappedAddress, net.ParseIP("192.0.2.1").To4(), 32853},
+		&AddressAttr{AttrSourceAddress, net.ParseIP("2001:db8::1"), 3478},
+		&XorAddressAttr{AttrXorMappedAddress, net.ParseIP("2001:db8::2"), 3479},
+		&ChangeRequestAttr{true, false},
+		&TextAttr{AttrUsername, "user"},
+		&ErrorCodeAttr{CodeUnknownAttribute, "Unknown Attribute"},
+		&UnknownAttributesAttr{[]AttrType{0x7f00, 0x7f01}},
+		&RawAttr{0x7f02, []byte{1, 2, 3}},
+	}
+	m := newMessage(BindReq, traId)
+	for _, attr := range attrs {
+		if err := m.addAttribute(attr); err != nil {
+			t.Fatalf("%T: %v", attr, err)
+		}
+	}
+	m.addAttribute(&RawAttr{0x7f02, []byte{4}})
+	decoded, err := ToMessage(m.ToRaw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, attr := range attrs {
+		got, ok := decoded.GetAttribute(attr.Type())
+		if !ok || !reflect.DeepEqual(got, attr) {
+			t.Fatalf("got %#v, want %#v", got, attr)
+		}
+	}
+	if repeated := decoded.GetAttributes(0x7f02); len(repeated) != 2 {
+		t.Fatalf("got %d repeated attributes", len(repeated))
+	}
+	if _, ok := decoded.Password(); ok {
+		t.Fatal("got a password that was never added")
+	}
+}
+
+type regionAttr struct {
+	Region string
+}
+
+func (a *regionAttr) Type() AttrType { return 0x7f10 }
+func (a *regionAttr) Encode(b []byte, traId [transactionIDSize]byte) ([]byte, error) {
+	return append(b, a.Region...), nil
+}
+func (a *regionAttr) Decode(value []byte, traId [transactionIDSize]byte) error {
+	a.Region = string(value)
+	return nil
+}
+func (a *regionAttr) String() string { return "region " + a.Region }
+
+func TestRegisterAttribute(t *testing.T) {
+	newRegion := func() Attribute { return &regionAttr{} }
+	if err := RegisterAttribute(0x7f10, "AttrRegion", newRegion); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterAttribute(0x7f10) })
+	if err := RegisterAttribute(0x7f10, "AttrRegion", newRegion); err == nil {
+		t.Fatal("registered an attribute twice")
+	}
+	if err := RegisterAttribute(AttrUsername, "AttrRegion", func() Attribute { return &TextAttr{AttrType: AttrUsername} }); err == nil {
+		t.Fatal("replaced a builtin attribute")
+	}
+	req, err := NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.AddAttribute(&regionAttr{"eu-west"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ToMessage(req.ToRaw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown := m.UnknownComprehensionRequired(); len(unknown) != 0 {
+		t.Fatalf("registered attribute reported unknown: %v", unknown)
+	}
+	attr, ok := m.GetAttribute(0x7f10)
+	if region, _ := attr.(*regionAttr); !ok || region.Region != "eu-west" {
+		t.Fatalf("got %#v", attr)
+	}
+	if s := m.ToString(); !strings.Contains(s, "AttrRegion: region eu-west") {
+		t.Fatalf("got %s", s)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	req, err := NewBindRequest(nil, "192.0.2.1:3478", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := req.ToRaw()
+	modern := NewRFC5389TransactionID()
+	resp, err := NewBindResponse(modern[:], "192.0.2.1:32853", "192.0.2.2:3478", "192.0.2.3:3479")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprinted := resp.ToRaw()
+	edit := func(raw []byte, f func(raw []byte) []byte) []byte {
+		return f(append([]byte(nil), raw...))
+	}
+	for _, test := range []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"bad type", edit(valid, func(b []byte) []byte { b[0] = 0x7f; return b }), ErrBadMessageType},
+		{"short header", valid[:messageHeaderSize-1], ErrTruncated},
+		{"short payload", valid[:len(valid)-4], ErrTruncated},
+		{"trailing bytes", append(edit(valid, func(b []byte) []byte { return b }), 0, 0, 0, 0), ErrBadLength},
+		{"unaligned length", edit(valid, func(b []byte) []byte {
+			bin.PutUint16(b[2:], bin.Uint16(b[2:])+1)
+			return append(b, 0)
+		}), ErrBadLength},
+		{"attribute exceeds message", edit(valid, func(b []byte) []byte {
+			bin.PutUint16(b[messageHeaderSize+2:], 0x00ff)
+			return b
+		}), ErrBadLength},
+		{"bad address", edit(valid, func(b []byte) []byte {
+			b[messageHeaderSize+5] = 0x03 // family
+			return b
+		}), ErrBadAttribute},
+		{"bad fingerprint", edit(fingerprinted, func(b []byte) []byte {
+			b[len(b)-1] ^= 0x01
+			return b
+		}), ErrFingerprintMismatch},
+		{"long fingerprint", edit(fingerprinted, func(b []byte) []byte {
+			b = append(b, 0, 0, 0, 0)
+			bin.PutUint16(b[2:], uint16(len(b)-messageHeaderSize))
+			bin.PutUint16(b[len(b)-10:], 8)
+			return b
+		}), ErrBadAttribute},
+		{"attribute after fingerprint", edit(fingerprinted, func(b []byte) []byte {
+			b = append(b, 0x80, 0x99, 0, 0)
+			bin.PutUint16(b[2:], uint16(len(b)-messageHeaderSize))
+			return b
+		}), ErrBadAttribute},
+	} {
+		if _, err := ToMessage(test.raw); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func FuzzToMessage(f *testing.F) {
+	for _, seed := range []string{
+		"000100189566c74d10037c4d7bbb0407d1e2c649000200080001303c2418eec20003000400000004",
+		"0101003c2112a442b7e7a701bc34d686fa87dfae8022000b7465737420766563746f7220002000080001a147e112a643000800142b91f599fd9e90c38c7489f92af9ba53f06be7d780280004c07d4c96",
+		"010100482112a442b7e7a701bc34d686fa87dfae8022000b7465737420766563746f7220002000140002a1470113a9faa5d3f179bc25f4b5bed2b9d900080014a382954e4be67bf11784c97c8292c275bfe3ed4180280004c8fb0b4c",
+	} {
+		raw, _ := hex.DecodeString(seed)
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		m, err := ToMessage(raw)
+		if err != nil {
+			return
+		}
+		m.ToString()
+		m.VerifyIntegrity([]byte("key"))
+		// attributes survive encoding, MESSAGE-INTEGRITY is dropped and
+		// FINGERPRINT recomputed
+		again, err := ToMessage(m.(InMessage).ToRaw())
+		if err != nil {
+			t.Fatalf("decoding the encoded message: %v", err)
+		}
+		if again.TransactionId() != m.TransactionId() || again.MessageType() != m.MessageType() {
+			t.Fatal("header changed")
+		}
+		want, got := m.(*Message).attributes, again.(*Message).attributes
+		for len(want) > 0 && len(got) > 0 {
+			switch {
+			case want[0].attrType == AttrMessageIntegrity || want[0].attrType == AttrFingerprint:
+				want = want[1:]
+			case got[0].attrType == AttrFingerprint:
+				got = got[1:]
+			case !reflect.DeepEqual(want[0], got[0]):
+				t.Fatalf("got %v, want %v", got[0], want[0])
+			default:
+				want, got = want[1:], got[1:]
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{}, "192.0.2.1:3478", "user", true, false, uint16(420), "reason")
+	f.Add([]byte("\x21\x12\xa4\x42abcdefghijkl"), "[2001:db8::1]:1", "", false, true, uint16(600), "")
+	f.Fuzz(func(t *testing.T, traId []byte, address, username string, changeIp, changePort bool, code uint16, reason string) {
+		if host, _, err := net.SplitHostPort(address); err == nil && net.ParseIP(host) == nil {
+			return // keep the resolver out of it
+		}
+		req, err := NewAuthBindRequest(traId, address, changeIp, changePort, username)
+		if err == nil {
+			m, err := ToMessage(req.AddIntegrityAttrAnd2Raw([]byte("key")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.VerifyIntegrity([]byte("key")); err != nil {
+				t.Fatal(err)
+			}
+			if u, _ := m.Username(); u != username {
+				t.Fatalf("got username %q, want %q", u, username)
+			}
+			if ip, port, _ := m.ChangeRequest(); ip != changeIp || port != changePort {
+				t.Fatalf("got change request %v %v", ip, port)
+			}
+		}
+		resp, err := NewBindErrorResponse(traId, ErrorCode(code), reason)
+		if err != nil {
+			return
+		}
+		m, err := ToMessage(resp.ToRaw())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, r, _ := m.ErrorCode(); c != ErrorCode(code) || (reason != "" && r != strings.TrimRight(reason, " ")) {
+			t.Fatalf("got %d %q, want %d %q", c, r, code, reason)
+		}
+	})
+}
+
+func TestMessageReuse(t *testing.T) {
+	traId := NewRFC5389TransactionID()
+	req, err := NewBindRequest(traId[:], "", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := req.ToRaw()
+	mapped := netip.MustParseAddrPort("192.0.2.1:32853")
+	source := netip.MustParseAddrPort("[2001:db8::1]:3478")
+	var m, resp Message
+	out := make([]byte, 0, 1500)
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := m.Decode(raw); err != nil {
+			t.Fatal(err)
+		}
+		if changeIp, _, ok := m.ChangeRequest(); !ok || !changeIp || m.Contains(AttrResponseAddress) {
+			t.Fatal("lost change request")
+		}
+		if err := resp.SetBindResponse(m.TransactionId(), mapped, source, mapped); err != nil {
+			t.Fatal(err)
+		}
+		out = resp.Encode(out[:0])
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per request", allocs)
+	}
+	decoded, err := ToMessage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := decoded.XorMappedAddress(); addr.String() != mapped.String() {
+		t.Fatalf("got xor mapped address %v", addr)
+	}
+	if addr, _ := decoded.SourceAddress(); addr.String() != source.String() {
+		t.Fatalf("got source address %v", addr)
+	}
+	if software, _ := decoded.Software(); software != Software {
+		t.Fatalf("got software %q", software)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	raw, _ := hex.DecodeString("0101003c2112a442b7e7a701bc34d686fa87dfae" +
+		"8022000b7465737420766563746f7220" +
+		"002000080001a147e112a643" +
+		"000800142b91f599fd9e90c38c7489f92af9ba53f06be7d7" +
+		"80280004c07d4c96")
+	var m Message
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for i := 0; i < b.N; i++ {
+		if err := m.Decode(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	traId := NewRFC5389TransactionID()
+	mapped := netip.MustParseAddrPort("192.0.2.1:32853")
+	var m Message
+	buf := make([]byte, 0, 1500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.SetBindResponse(traId, mapped, mapped, mapped); err != nil {
+			b.Fatal(err)
+		}
+		buf = m.Encode(buf[:0])
+	}
+}
+
+func TestBuild(t *testing.T) {
+	traId := NewRFC5389TransactionID()
+	mapped := netip.MustParseAddrPort("192.0.2.1:32853")
+	// the transaction id applies to the XOR-MAPPED-ADDRESS before it
+	m, err := Build(BindingResponse,
+		WithXorMappedAddress(mapped),
+		WithAddress(AttrMappedAddress, mapped),
+		WithSoftware("test"),
+		WithAttribute(&RawAttr{0x8099, []byte("vendor")}),
+		WithTransactionID(traId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ToMessage(m.ToRaw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TransactionId() != traId || decoded.MessageType() != BindResp {
+		t.Fatal("header mismatch")
+	}
+	if addr, _ := decoded.XorMappedAddress(); addr.String() != mapped.String() {
+		t.Fatalf("got xor mapped address %v", addr)
+	}
+	if addr, _ := decoded.MappedAddress(); addr.String() != mapped.String() {
+		t.Fatalf("got mapped address %v", addr)
+	}
+	if attr, _ := decoded.GetAttribute(0x8099); string(attr.(*RawAttr).Value) != "vendor" {
+		t.Fatalf("got %v", attr)
+	}
+	if _, err := Build(BindReq, WithAttribute(&FingerprintAttr{})); err == nil {
+		t.Fatal("added a fingerprint")
+	}
+	if _, err := Build(BindReq, WithAddress(AttrResponseAddress, netip.AddrPort{})); err == nil {
+		t.Fatal("added an invalid address")
+	}
+}
+
+func TestBuildRaw(t *testing.T) {
+	traId := NewRFC5389TransactionID()
+	m, err := Build(BindingRequest,
+		WithTransactionID(traId),
+		WithRawAttribute(AttrMessageIntegrity, make([]byte, 20)),
+		WithUsername("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := m.EncodeWithIntegrity(nil, []byte("key"))
+	// the bogus integrity comes first, the encoder's follow the username
+	want := []AttrType{AttrMessageIntegrity, AttrUsername, AttrMessageIntegrity, AttrFingerprint}
+	var got []AttrType
+	for p := messageHeaderSize; p+4 <= len(raw); p += 4 + paddedLength(int(bin.Uint16(raw[p+2:]))) {
+		got = append(got, AttrType(bin.Uint16(raw[p:])))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("encoded %v, want %v", got, want)
+	}
+	if _, err := ToMessage(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAttributeLength(raw, 1, 0xff); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAttributeLength(raw, 4, 0); err == nil {
+		t.Fatal("set the length of a missing attribute")
+	}
+	if _, err := ToMessage(raw); !errors.Is(err, ErrBadLength) {
+		t.Fatalf("decoded an overlong attribute: %v", err)
+	}
+	if err := SetMessageLength(raw, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ToMessage(raw); !errors.Is(err, ErrBadLength) {
+		t.Fatalf("decoded a bad length: %v", err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	traId := NewRFC5389TransactionID()
+	mapped := netip.MustParseAddrPort("[2001:db8::1]:3478")
+	m, err := Build(BindErrorResp,
+		WithTransactionID(traId),
+		WithXorMappedAddress(mapped),
+		WithChangeRequest(false, true),
+		WithErrorCode(CodeUnknownAttribute, ""),
+		WithUnknownAttributes(AttrType(0x7f00), AttrUsername),
+		WithAttribute(&RawAttr{0x8099, []byte{1, 2}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ToMessage(m.AddIntegrityAttrAnd2Raw([]byte("key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"type":"BindErrorResp"`, `"[2001:db8::1]:3478"`, `["0x7f00","AttrUsername"]`, `"type":"AttrMessageIntegrity"`} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("%s does not contain %s", b, want)
+		}
+	}
+	var again Message
+	if err := json.Unmarshal(b, &again); err != nil {
+		t.Fatal(err)
+	}
+	if raw := again.ToRaw(); !bytes.Equal(raw, m.ToRaw()) {
+		t.Fatalf("got %x, want %x", raw, m.ToRaw())
+	}
+
+	dump := decoded.Dump()
+	for _, want := range []string{"BindErrorResp (0x0111)", "AttrErrorCode (0x0009), length 24: 420 Unknown Attribute", "0x8099 (0x8099), length 2"} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("%s does not contain %s", dump, want)
+		}
+	}
+}
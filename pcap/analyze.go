@@ -0,0 +1,111 @@
+package pcap
+
+import (
+	"io"
+	"net/netip"
+	"stun"
+	"time"
+)
+
+// Transaction is a request seen in a capture and the response to it.
+type Transaction struct {
+	TransactionId [16]byte
+	Client        netip.AddrPort
+	Server        netip.AddrPort
+	Request       stun.MessageType
+	Response      stun.MessageType // zero if the request was not answered
+	Sent          time.Time        // when the first request was captured
+	Received      time.Time
+	Retransmits   int
+	// RTT is measured from the last request captured before the response, so
+	// a retransmitted request is not counted against the server.
+	RTT           time.Duration
+	MappedAddress string // XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS
+	ErrorCode     stun.ErrorCode
+
+	lastSent time.Time
+}
+
+// Answered tells whether a response to t was captured.
+func (t *Transaction) Answered() bool {
+	return t.Response != 0
+}
+
+// Report is what Analyze found in a capture, transactions in the order their
+// first request was captured.
+type Report struct {
+	Transactions []*Transaction
+	// Malformed counts UDP payloads that look like STUN but do not decode.
+	Malformed int
+	// UnmatchedResponses counts responses to requests that were not captured.
+	UnmatchedResponses int
+}
+
+// Analyze reads every packet of r, decodes the STUN messages carried over UDP
+// and pairs requests and responses by transaction id.
+func Analyze(r *Reader) (*Report, error) {
+	report := &Report{}
+	pending := map[[16]byte]*Transaction{}
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		src, dst, payload, ok := UDP(p.LinkType, p.Data)
+		if !ok || !stun.IsMessage(payload) {
+			continue
+		}
+		msg, err := stun.ToMessage(payload)
+		if err != nil {
+			report.Malformed++
+			continue
+		}
+		traId := msg.TransactionId()
+		if isRequest(msg.MessageType()) {
+			t, ok := pending[traId]
+			if !ok {
+				t = &Transaction{
+					TransactionId: traId,
+					Client:        src,
+					Server:        dst,
+					Request:       msg.MessageType(),
+					Sent:          p.Timestamp,
+				}
+				pending[traId] = t
+				report.Transactions = append(report.Transactions, t)
+			} else if !t.Answered() {
+				t.Retransmits++
+			}
+			t.lastSent = p.Timestamp
+			continue
+		}
+		t, ok := pending[traId]
+		if !ok {
+			report.UnmatchedResponses++
+			continue
+		}
+		if t.Answered() {
+			// a response to a retransmission
+			continue
+		}
+		t.Response, t.Received = msg.MessageType(), p.Timestamp
+		t.RTT = p.Timestamp.Sub(t.lastSent)
+		if addr, ok := msg.XorMappedAddress(); ok {
+			t.MappedAddress = addr.String()
+		} else if addr, ok := msg.MappedAddress(); ok {
+			t.MappedAddress = addr.String()
+		}
+		if code, _, ok := msg.ErrorCode(); ok {
+			t.ErrorCode = code
+		}
+	}
+}
+
+// isRequest tells requests from responses and error responses by the class
+// bits of the message type.
+func isRequest(messageType stun.MessageType) bool {
+	return messageType&0x0110 == 0
+}
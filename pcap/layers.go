@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	protocolUDP    = 17
+	ipv6HopByHop   = 0
+	ipv6Routing    = 43
+	ipv6Fragment   = 44
+	ipv6DestOpts   = 60
+	udpHeaderSize  = 8
+	ipv6HeaderSize = 40
+)
+
+var be = binary.BigEndian
+
+// UDP returns the addresses and payload of the UDP datagram carried by a
+// frame of linkType. ok is false for anything else, including fragments
+// after the first one, which cannot be decoded without reassembly.
+func UDP(linkType LinkType, data []byte) (src, dst netip.AddrPort, payload []byte, ok bool) {
+	var ip []byte
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return
+		}
+		etherType, p := be.Uint16(data[12:]), 14
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(data) >= p+4 {
+			etherType, p = be.Uint16(data[p+2:]), p+4
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return
+		}
+		ip = data[p:]
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return
+		}
+		ip = data[16:]
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return
+		}
+		ip = data[4:]
+	case LinkTypeRaw:
+		ip = data
+	default:
+		return
+	}
+	if len(ip) == 0 {
+		return
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		return ipv4UDP(ip)
+	case 6:
+		return ipv6UDP(ip)
+	}
+	return
+}
+func ipv4UDP(ip []byte) (src, dst netip.AddrPort, payload []byte, ok bool) {
+	if len(ip) < 20 {
+		return
+	}
+	headerSize, total := int(ip[0]&0x0f)*4, int(be.Uint16(ip[2:]))
+	if headerSize < 20 || total < headerSize || len(ip) < total {
+		return
+	}
+	if ip[9] != protocolUDP || be.Uint16(ip[6:])&0x1fff != 0 {
+		return
+	}
+	srcIP, _ := netip.AddrFromSlice(ip[12:16])
+	dstIP, _ := netip.AddrFromSlice(ip[16:20])
+	return udp(srcIP, dstIP, ip[headerSize:total])
+}
+func ipv6UDP(ip []byte) (src, dst netip.AddrPort, payload []byte, ok bool) {
+	if len(ip) < ipv6HeaderSize {
+		return
+	}
+	total := ipv6HeaderSize + int(be.Uint16(ip[4:]))
+	if len(ip) < total {
+		return
+	}
+	next, p := ip[6], ipv6HeaderSize
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if total < p+8 {
+				return
+			}
+			next, p = ip[p], p+(int(ip[p+1])+1)*8
+			continue
+		case ipv6Fragment:
+			if total < p+8 || be.Uint16(ip[p+2:])&0xfff8 != 0 {
+				return
+			}
+			next, p = ip[p], p+8
+			continue
+		case protocolUDP:
+		default:
+			return
+		}
+		break
+	}
+	if total < p {
+		return
+	}
+	srcIP, _ := netip.AddrFromSlice(ip[8:24])
+	dstIP, _ := netip.AddrFromSlice(ip[24:40])
+	return udp(srcIP, dstIP, ip[p:total])
+}
+func udp(srcIP, dstIP netip.Addr, datagram []byte) (src, dst netip.AddrPort, payload []byte, ok bool) {
+	if len(datagram) < udpHeaderSize {
+		return
+	}
+	length := int(be.Uint16(datagram[4:]))
+	if length < udpHeaderSize || length > len(datagram) {
+		return
+	}
+	src = netip.AddrPortFrom(srcIP, be.Uint16(datagram))
+	dst = netip.AddrPortFrom(dstIP, be.Uint16(datagram[2:]))
+	return src, dst, datagram[udpHeaderSize:length], true
+}
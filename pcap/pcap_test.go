@@ -0,0 +1,338 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"stun"
+	"stun/internal/packet"
+	"testing"
+	"time"
+)
+
+var (
+	client4 = netip.MustParseAddrPort("192.168.1.10:54321")
+	server4 = netip.MustParseAddrPort("198.51.100.1:3478")
+	client6 = netip.MustParseAddrPort("[2001:db8::10]:54321")
+	server6 = netip.MustParseAddrPort("[2001:db8::1]:3478")
+	mapped  = netip.MustParseAddrPort("203.0.113.7:40000")
+)
+
+// frame returns an Ethernet frame carrying payload over UDP from src to dst.
+func frame(src, dst netip.AddrPort, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	be.PutUint16(udp, src.Port())
+	be.PutUint16(udp[2:], dst.Port())
+	be.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	eth := make([]byte, 14)
+	var ip []byte
+	if src.Addr().Is4() {
+		be.PutUint16(eth[12:], etherTypeIPv4)
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		be.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8], ip[9] = 64, protocolUDP
+		copy(ip[12:], src.Addr().AsSlice())
+		copy(ip[16:], dst.Addr().AsSlice())
+	} else {
+		be.PutUint16(eth[12:], etherTypeIPv6)
+		// a hop-by-hop options header in front of UDP
+		ip = make([]byte, 48)
+		ip[0] = 0x60
+		be.PutUint16(ip[4:], uint16(8+len(udp)))
+		ip[6], ip[7] = ipv6HopByHop, 64
+		copy(ip[8:], src.Addr().AsSlice())
+		copy(ip[24:], dst.Addr().AsSlice())
+		ip[40] = protocolUDP
+	}
+	return append(append(eth, ip...), udp...)
+}
+
+type capture struct {
+	at    time.Duration
+	frame []byte
+}
+
+func writePcap(packets []capture) []byte {
+	b := make([]byte, 24)
+	le := binary.LittleEndian
+	le.PutUint32(b, magicMicroseconds)
+	le.PutUint16(b[4:], 2)
+	le.PutUint16(b[6:], 4)
+	le.PutUint32(b[16:], 65535)
+	le.PutUint32(b[20:], uint32(LinkTypeEthernet))
+	for _, p := range packets {
+		ts := time.Unix(1700000000, 0).Add(p.at)
+		h := make([]byte, 16)
+		le.PutUint32(h, uint32(ts.Unix()))
+		le.PutUint32(h[4:], uint32(ts.Nanosecond()/1000))
+		le.PutUint32(h[8:], uint32(len(p.frame)))
+		le.PutUint32(h[12:], uint32(len(p.frame)))
+		b = append(append(b, h...), p.frame...)
+	}
+	return b
+}
+
+// writePcapng writes a big endian section with one interface whose
+// timestamps are in nanoseconds.
+func writePcapng(packets []capture) []byte {
+	order := binary.BigEndian
+	block := func(blockType uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b := make([]byte, 8, 12+len(body))
+		order.PutUint32(b, blockType)
+		order.PutUint32(b[4:], uint32(12+len(body)))
+		b = append(b, body...)
+		b = append(b, 0, 0, 0, 0)
+		order.PutUint32(b[len(b)-4:], uint32(12+len(body)))
+		return b
+	}
+	shb := make([]byte, 16)
+	order.PutUint32(shb, byteOrderMagic)
+	order.PutUint16(shb[4:], 1)
+	order.PutUint64(shb[8:], ^uint64(0))
+	b := block(blockSectionHeader, shb)
+
+	idb := make([]byte, 8)
+	order.PutUint16(idb, uint16(LinkTypeEthernet))
+	// if_tsresol 9, then opt_endofopt
+	idb = append(idb, 0, optionTimestampResol, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0)
+	b = append(b, block(blockInterface, idb)...)
+
+	for _, p := range packets {
+		ts := uint64(time.Unix(1700000000, 0).Add(p.at).UnixNano())
+		epb := make([]byte, 20)
+		order.PutUint32(epb[4:], uint32(ts>>32))
+		order.PutUint32(epb[8:], uint32(ts))
+		order.PutUint32(epb[12:], uint32(len(p.frame)))
+		order.PutUint32(epb[16:], uint32(len(p.frame)))
+		b = append(b, block(blockEnhancedPacket, append(epb, p.frame...))...)
+	}
+	return b
+}
+
+func encode(t *testing.T, messageType stun.MessageType, traId [16]byte, opts ...stun.Option) []byte {
+	m, err := stun.Build(messageType, append([]stun.Option{stun.WithTransactionID(traId)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Encode(nil)
+}
+
+func TestUDP(t *testing.T) {
+	for _, addrs := range [][2]netip.AddrPort{{client4, server4}, {client6, server6}} {
+		src, dst, payload, ok := UDP(LinkTypeEthernet, frame(addrs[0], addrs[1], []byte("payload")))
+		if !ok || src != addrs[0] || dst != addrs[1] || string(payload) != "payload" {
+			t.Errorf("UDP(%v) = %v, %v, %q, %v", addrs, src, dst, payload, ok)
+		}
+	}
+	f := frame(client4, server4, []byte("payload"))
+	// a second fragment
+	be.PutUint16(f[14+6:], 100)
+	if _, _, _, ok := UDP(LinkTypeEthernet, f); ok {
+		t.Error("decoded a non-first fragment")
+	}
+	if _, _, payload, ok := UDP(LinkTypeRaw, frame(client4, server4, []byte("raw"))[14:]); !ok || string(payload) != "raw" {
+		t.Errorf("raw ip: %q, %v", payload, ok)
+	}
+	for i := range f {
+		UDP(LinkTypeEthernet, f[:i])
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	answered, lost, errored := stun.NewTransactionID(), stun.NewTransactionID(), stun.NewRFC5389TransactionID()
+	unmatched := stun.NewTransactionID()
+	bindReq := encode(t, stun.BindReq, answered)
+	packets := []capture{
+		{0, frame(client4, server4, bindReq)},
+		{100 * time.Millisecond, frame(client4, server4, bindReq)},
+		{110 * time.Millisecond, frame(client4, server4, encode(t, stun.BindReq, lost))},
+		{130 * time.Millisecond, frame(server4, client4, encode(t, stun.BindResp, answered,
+			stun.WithAddress(stun.AttrMappedAddress, mapped)))},
+		{140 * time.Millisecond, frame(server4, client4, encode(t, stun.BindResp, answered,
+			stun.WithAddress(stun.AttrMappedAddress, mapped)))},
+		{200 * time.Millisecond, frame(server4, client4, encode(t, stun.BindResp, unmatched))},
+		{300 * time.Millisecond, frame(client6, server6, encode(t, stun.BindReq, errored))},
+		{312 * time.Millisecond, frame(server6, client6, encode(t, stun.BindErrorResp, errored,
+			stun.WithErrorCode(stun.CodeBadRequest, "")))},
+		// a truncated binding request
+		{400 * time.Millisecond, frame(client4, server4, bindReq[:20+2])},
+		{500 * time.Millisecond, frame(client4, server4, []byte("not stun"))},
+	}
+	for name, capture := range map[string][]byte{
+		"pcap":   writePcap(packets),
+		"pcapng": writePcapng(packets),
+	} {
+		r, err := NewReader(bytes.NewReader(capture))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		report, err := Analyze(r)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if report.Malformed != 1 || report.UnmatchedResponses != 1 || len(report.Transactions) != 3 {
+			t.Fatalf("%s: %+v", name, report)
+		}
+		a, l, e := report.Transactions[0], report.Transactions[1], report.Transactions[2]
+		if a.TransactionId != answered || a.Client != client4 || a.Server != server4 ||
+			!a.Answered() || a.Retransmits != 1 || a.RTT != 30*time.Millisecond ||
+			a.Received.Sub(a.Sent) != 130*time.Millisecond || a.MappedAddress != mapped.String() {
+			t.Errorf("%s: answered %+v", name, a)
+		}
+		if l.TransactionId != lost || l.Answered() {
+			t.Errorf("%s: lost %+v", name, l)
+		}
+		if e.TransactionId != errored || e.Client != client6 || e.Response != stun.BindErrorResp ||
+			e.ErrorCode != stun.CodeBadRequest || e.RTT != 12*time.Millisecond {
+			t.Errorf("%s: error %+v", name, e)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture file at all"))); err != ErrNotCapture {
+		t.Errorf("NewReader = %v", err)
+	}
+	packets := []capture{{0, frame(client4, server4, []byte("payload"))}}
+	pcap := writePcap(packets)
+	for i := 25; i < len(pcap); i++ {
+		r, err := NewReader(bytes.NewReader(pcap[:i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err != ErrCorrupt {
+			t.Errorf("truncated at %d: %v", i, err)
+		}
+	}
+	pcapng := writePcapng(packets)
+	for i := range pcapng {
+		if r, err := NewReader(bytes.NewReader(pcapng[:i])); err == nil {
+			for err == nil {
+				_, err = r.Next()
+			}
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, LinkTypeRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	for _, addrs := range [][2]netip.AddrPort{
+		{client4, server4},
+		{client6, server6},
+		{client4, netip.MustParseAddrPort("[::]:3478")},
+	} {
+		raw := AppendUDP(nil, addrs[0], addrs[1], []byte("payload"))
+		if raw[0]>>4 == 4 && packet.Checksum(0, raw[:20]) != 0xffff {
+			t.Errorf("%v: bad ip checksum", addrs)
+		}
+		if err := w.WritePacket(ts, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][2]string{
+		{client4.String(), server4.String()},
+		{client6.String(), server6.String()},
+		{client4.String(), "0.0.0.0:3478"},
+	} {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, dst, payload, ok := UDP(p.LinkType, p.Data)
+		if !p.Timestamp.Equal(ts) || !ok || src.String() != want[0] || dst.String() != want[1] || string(payload) != "payload" {
+			t.Errorf("got %v %v -> %v %q %v, want %v", p.Timestamp, src, dst, payload, ok, want)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stun.pcap")
+	// two packets of 16+28+32 bytes fit after the file header
+	r, err := NewRecorder(path, 24+2*76, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, 32)
+	start := time.Now()
+	for i, at := range []time.Duration{0, 1, 2, 3, 2 * time.Minute} {
+		if err := r.RecordUDP(start.Add(at), client4, server4, payload); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "stun-*.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts []int
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pr, err := NewReader(f)
+		if err != nil {
+			t.Fatal(file, err)
+		}
+		n := 0
+		for ; ; n++ {
+			if _, err := pr.Next(); err != nil {
+				break
+			}
+		}
+		f.Close()
+		counts = append(counts, n)
+	}
+	sort.Ints(counts)
+	if !reflect.DeepEqual(counts, []int{1, 2, 2}) {
+		t.Errorf("packets per file %v", counts)
+	}
+}
+func TestRecorderFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stun.pcap")
+	r, err := NewRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.RecordUDP(time.Now(), client4, server4, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	// no second packet or Close flushes it
+	deadline := time.Now().Add(flushInterval + 500*time.Millisecond)
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 24+16+28+32 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d bytes in the file after %v", info.Size(), flushInterval)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
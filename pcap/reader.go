@@ -0,0 +1,244 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// LinkType is the link-layer header type of the packets of a capture, see
+// https://www.tcpdump.org/linktypes.html.
+type LinkType uint32
+
+const (
+	LinkTypeNull     LinkType = 0   // BSD loopback
+	LinkTypeEthernet LinkType = 1   // IEEE 802.3 Ethernet
+	LinkTypeRaw      LinkType = 101 // raw IPv4 or IPv6
+	LinkTypeLinuxSLL LinkType = 113 // Linux cooked capture
+)
+
+const (
+	magicMicroseconds    = 0xa1b2c3d4
+	magicNanoseconds     = 0xa1b23c4d
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterface       = 0x00000001
+	blockSimplePacket    = 0x00000003
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	optionTimestampResol = 9
+
+	// maxPacketSize bounds the captured length a corrupt file can make the
+	// reader allocate.
+	maxPacketSize = 256 * 1024
+)
+
+var (
+	ErrNotCapture = errors.New("not a pcap or pcapng file")
+	ErrCorrupt    = errors.New("corrupt capture")
+)
+
+// Packet is a captured frame. Data is only valid until the next call to Next.
+type Packet struct {
+	Timestamp time.Time
+	LinkType  LinkType
+	Data      []byte
+}
+
+// iface is a pcapng Interface Description Block.
+type iface struct {
+	linkType LinkType
+	units    uint64 // timestamp units per second
+}
+
+// Reader reads packets from a pcap or pcapng file.
+type Reader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	ng     bool
+	header [16]byte
+	buf    []byte
+
+	// pcap
+	linkType LinkType
+	nano     bool
+
+	// pcapng
+	ifaces []iface
+}
+
+// NewReader reads the file header from r and tells pcap from pcapng.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, ErrNotCapture
+	}
+	if binary.BigEndian.Uint32(magic) == blockSectionHeader {
+		pr.ng = true
+		// the Section Header Block is read by Next like any other block
+		return pr, nil
+	}
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		return nil, ErrNotCapture
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header) {
+		case magicMicroseconds:
+			pr.order = order
+		case magicNanoseconds:
+			pr.order, pr.nano = order, true
+		default:
+			continue
+		}
+		// the upper bits hold the FCS length
+		pr.linkType = LinkType(order.Uint32(header[20:]) & 0x0fffffff)
+		return pr, nil
+	}
+	return nil, ErrNotCapture
+}
+
+// Next returns the next packet, or io.EOF at the end of the file.
+func (r *Reader) Next() (Packet, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+	header := r.header[:16]
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, ErrCorrupt
+		}
+		return Packet{}, err
+	}
+	sec, frac := r.order.Uint32(header), r.order.Uint32(header[4:])
+	length := r.order.Uint32(header[8:])
+	if length > maxPacketSize {
+		return Packet{}, ErrCorrupt
+	}
+	data, err := r.read(int(length))
+	if err != nil {
+		return Packet{}, err
+	}
+	nsec := int64(frac) * 1000
+	if r.nano {
+		nsec = int64(frac)
+	}
+	return Packet{time.Unix(int64(sec), nsec).UTC(), r.linkType, data}, nil
+}
+func (r *Reader) read(n int) ([]byte, error) {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return nil, ErrCorrupt
+	}
+	return r.buf, nil
+}
+
+// nextBlock reads pcapng blocks until it finds a packet.
+func (r *Reader) nextBlock() (Packet, error) {
+	for {
+		header := r.header[:8]
+		if _, err := io.ReadFull(r.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return Packet{}, ErrCorrupt
+			}
+			return Packet{}, err
+		}
+		if binary.BigEndian.Uint32(header) == blockSectionHeader {
+			bom, err := r.r.Peek(4)
+			if err != nil {
+				return Packet{}, ErrCorrupt
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom) == byteOrderMagic:
+				r.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom) == byteOrderMagic:
+				r.order = binary.BigEndian
+			default:
+				return Packet{}, ErrCorrupt
+			}
+			r.ifaces = r.ifaces[:0]
+		}
+		if r.order == nil {
+			return Packet{}, ErrCorrupt
+		}
+		blockType, length := r.order.Uint32(header), r.order.Uint32(header[4:])
+		if length < 12 || length%4 != 0 || length > maxPacketSize {
+			return Packet{}, ErrCorrupt
+		}
+		body, err := r.read(int(length) - 8)
+		if err != nil {
+			return Packet{}, err
+		}
+		body = body[:len(body)-4] // trailing total length
+		switch blockType {
+		case blockInterface:
+			if len(body) < 8 {
+				return Packet{}, ErrCorrupt
+			}
+			r.ifaces = append(r.ifaces, iface{
+				linkType: LinkType(r.order.Uint16(body)),
+				units:    r.timestampUnits(body[8:]),
+			})
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return Packet{}, ErrCorrupt
+			}
+			id, captured := r.order.Uint32(body), r.order.Uint32(body[12:])
+			if int(id) >= len(r.ifaces) || int(captured) > len(body)-20 {
+				return Packet{}, ErrCorrupt
+			}
+			ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+			i := r.ifaces[id]
+			return Packet{timestamp(ts, i.units), i.linkType, body[20 : 20+captured]}, nil
+		case blockSimplePacket:
+			if len(body) < 4 || len(r.ifaces) == 0 {
+				return Packet{}, ErrCorrupt
+			}
+			data := body[4:]
+			if original := int(r.order.Uint32(body)); original < len(data) {
+				data = data[:original]
+			}
+			return Packet{time.Time{}, r.ifaces[0].linkType, data}, nil
+		}
+	}
+}
+
+// timestampUnits reads the if_tsresol option, the default is microseconds.
+func (r *Reader) timestampUnits(options []byte) uint64 {
+	for len(options) >= 4 {
+		code, length := r.order.Uint16(options), int(r.order.Uint16(options[2:]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == optionTimestampResol && length == 1 {
+			v := options[4]
+			units := uint64(1)
+			for i := 0; i < int(v&0x7f) && units < 1e18; i++ {
+				if v&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+			return units
+		}
+		next := 4 + (length+3)&^3
+		if next > len(options) {
+			break
+		}
+		options = options[next:]
+	}
+	return 1e6
+}
+func timestamp(ts, units uint64) time.Time {
+	sec := ts / units
+	hi, lo := bits.Mul64(ts%units, 1e9)
+	nsec, _ := bits.Div64(hi, lo, units)
+	return time.Unix(int64(sec), int64(nsec)).UTC()
+}
@@ -0,0 +1,141 @@
+package pcap
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flushInterval bounds how long a recorded packet stays buffered.
+const flushInterval = time.Second
+
+// Recorder writes packets to a pcap file of raw IP, starting a new file when
+// the current one reaches maxSize bytes or was opened maxAge ago. It is safe
+// for concurrent use.
+type Recorder struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	w       *Writer
+	size    int64
+	opened  time.Time
+	flush   *time.Timer // pending flush of buf, nil once flushed
+	scratch []byte
+}
+
+// NewRecorder opens the first file of a recorder writing to path, a zero
+// maxSize or maxAge disables rotation by size or by age. With rotation the
+// time a file is opened is added to its name, stun.pcap becoming
+// stun-20060102T150405.000.pcap, so that rotated files are kept.
+func NewRecorder(path string, maxSize int64, maxAge time.Duration) (*Recorder, error) {
+	r := &Recorder{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RecordUDP records a UDP datagram from src to dst received or sent at ts.
+func (r *Recorder) RecordUDP(ts time.Time, src, dst netip.AddrPort, payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scratch = AppendUDP(r.scratch[:0], src, dst, payload)
+	return r.write(ts, r.scratch)
+}
+
+// Close flushes and closes the current file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+func (r *Recorder) write(ts time.Time, packet []byte) error {
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	size := int64(16 + len(packet))
+	if (r.maxSize > 0 && r.size > 24 && r.size+size > r.maxSize) ||
+		(r.maxAge > 0 && ts.Sub(r.opened) >= r.maxAge) {
+		if err := r.close(); err != nil {
+			return err
+		}
+		if err := r.open(ts); err != nil {
+			return err
+		}
+	}
+	if err := r.w.WritePacket(ts, packet); err != nil {
+		return err
+	}
+	r.size += size
+	if r.flush == nil {
+		r.flush = time.AfterFunc(flushInterval, r.flushBuffered)
+	}
+	return nil
+}
+
+// flushBuffered writes the buffered packets to the file, flushInterval after
+// the first of them was recorded.
+func (r *Recorder) flushBuffered() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flush = nil
+	if r.file != nil {
+		r.buf.Flush()
+	}
+}
+func (r *Recorder) open(now time.Time) error {
+	var file *os.File
+	var err error
+	if r.maxSize > 0 || r.maxAge > 0 {
+		ext := filepath.Ext(r.path)
+		base := strings.TrimSuffix(r.path, ext) + "-" + now.UTC().Format("20060102T150405.000")
+		// files rotated within the same millisecond get a sequence number
+		for i := 0; ; i++ {
+			path := base + ext
+			if i > 0 {
+				path = fmt.Sprintf("%s-%d%s", base, i, ext)
+			}
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if !os.IsExist(err) {
+				break
+			}
+		}
+	} else {
+		file, err = os.Create(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(file)
+	w, err := NewWriter(buf, LinkTypeRaw)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.buf, r.w, r.size, r.opened = file, buf, w, 24, now
+	return nil
+}
+func (r *Recorder) close() error {
+	if r.file == nil {
+		return nil
+	}
+	if r.flush != nil {
+		r.flush.Stop()
+		r.flush = nil
+	}
+	err := r.buf.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
@@ -0,0 +1,57 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"stun/internal/packet"
+	"time"
+)
+
+// Writer writes packets to a pcap file with nanosecond timestamps.
+type Writer struct {
+	w        io.Writer
+	linkType LinkType
+	header   [16]byte
+}
+
+// NewWriter writes the file header to w. Packets written with WriteUDP are
+// synthesized as raw IP, so linkType should be LinkTypeRaw to mix them with
+// packets written with WritePacket.
+func NewWriter(w io.Writer, linkType LinkType) (*Writer, error) {
+	header := make([]byte, 24)
+	le := binary.LittleEndian
+	le.PutUint32(header, magicNanoseconds)
+	le.PutUint16(header[4:], 2)
+	le.PutUint16(header[6:], 4)
+	le.PutUint32(header[16:], maxPacketSize)
+	le.PutUint32(header[20:], uint32(linkType))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, linkType: linkType}, nil
+}
+
+// WritePacket writes a frame of the link type of the file.
+func (w *Writer) WritePacket(ts time.Time, data []byte) error {
+	if len(data) > maxPacketSize {
+		data = data[:maxPacketSize]
+	}
+	le := binary.LittleEndian
+	le.PutUint32(w.header[:], uint32(ts.Unix()))
+	le.PutUint32(w.header[4:], uint32(ts.Nanosecond()))
+	le.PutUint32(w.header[8:], uint32(len(data)))
+	le.PutUint32(w.header[12:], uint32(len(data)))
+	if _, err := w.w.Write(w.header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// AppendUDP appends an IPv4 or IPv6 packet carrying payload over UDP from src
+// to dst. An IPv4 address facing an IPv6 one is mapped, unless the IPv6 one
+// is unspecified, as the local address of a wildcard socket is.
+func AppendUDP(b []byte, src, dst netip.AddrPort, payload []byte) []byte {
+	return packet.AppendUDP(b, src, dst, payload, 0, 64)
+}
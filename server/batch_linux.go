@@ -0,0 +1,228 @@
+//go:build linux && (amd64 || arm64)
+
+package server
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// mmsgs is one direction of a batch: the headers, buffers, addresses and
+// control messages of its datagrams.
+type mmsgs struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	bufs  [][]byte
+	names []syscall.RawSockaddrAny
+	oobs  [][]byte
+}
+
+func newMmsgs(size, bufSize, oobSize int) mmsgs {
+	m := mmsgs{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		bufs:  make([][]byte, size),
+		names: make([]syscall.RawSockaddrAny, size),
+		oobs:  make([][]byte, size),
+	}
+	for i := range m.hdrs {
+		m.bufs[i] = make([]byte, bufSize)
+		m.iovs[i].Base = &m.bufs[i][0]
+		m.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&m.names[i]))
+		m.hdrs[i].hdr.Iov = &m.iovs[i]
+		m.hdrs[i].hdr.Iovlen = 1
+		if oobSize > 0 {
+			m.oobs[i] = make([]byte, oobSize)
+			m.hdrs[i].hdr.Control = &m.oobs[i][0]
+		}
+	}
+	return m
+}
+
+// batch reads the datagrams waiting on a socket and writes the responses to
+// them with one syscall each.
+type batch struct {
+	raw  syscall.RawConn
+	ipv4 bool // the socket is AF_INET
+
+	recv, send   mmsgs
+	n            int // datagrams read into recv
+	queued, sent int // responses queued in send, and those already sent
+	// srcs are the addresses the queued responses leave from, failed those
+	// sendmmsg rejected
+	srcs   []netip.AddrPort
+	failed []bool
+	err    error
+	// doRecv and doSend are kept to hand them to raw without allocating
+	doRecv, doSend func(fd uintptr) bool
+}
+
+// newBatch returns a batch of size datagrams of conn, an AF_INET socket when
+// ipv4 is set, read along with oobSize bytes of control messages.
+func newBatch(conn *net.UDPConn, size, oobSize int, ipv4 bool) (*batch, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	b := &batch{
+		raw:    raw,
+		ipv4:   ipv4,
+		recv:   newMmsgs(size, 1500, oobSize),
+		send:   newMmsgs(size, 1500, oobSize),
+		srcs:   make([]netip.AddrPort, size),
+		failed: make([]bool, size),
+	}
+	b.doRecv, b.doSend = b.recvmmsg, b.sendmmsg
+	return b, nil
+}
+func (b *batch) recvmmsg(fd uintptr) bool {
+	for {
+		n, _, errno := syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&b.recv.hdrs[0])), uintptr(len(b.recv.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+		switch errno {
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			return false
+		case 0:
+			b.n, b.err = int(n), nil
+		default:
+			b.n, b.err = 0, errno
+		}
+		return true
+	}
+}
+
+// read waits for datagrams and reads as many as the batch holds.
+func (b *batch) read() (int, error) {
+	for i := range b.recv.hdrs {
+		hdr := &b.recv.hdrs[i].hdr
+		hdr.Namelen = syscall.SizeofSockaddrAny
+		b.recv.iovs[i].SetLen(len(b.recv.bufs[i]))
+		hdr.SetControllen(len(b.recv.oobs[i]))
+		hdr.Flags = 0
+	}
+	if err := b.raw.Read(b.doRecv); err != nil {
+		return 0, err
+	}
+	return b.n, b.err
+}
+
+// message returns the i-th datagram read, its source and control messages.
+func (b *batch) message(i int) ([]byte, netip.AddrPort, []byte) {
+	hdr := &b.recv.hdrs[i]
+	return b.recv.bufs[i][:hdr.len], sockaddrAddrPort(&b.recv.names[i]), b.recv.oobs[i][:hdr.hdr.Controllen]
+}
+
+// queue adds p, sent from src to rAddr with the control messages oob, to the
+// responses written by flush. It reports false when p does not fit, then
+// p is to be written on its own.
+func (b *batch) queue(p []byte, src, rAddr netip.AddrPort, oob []byte) bool {
+	if b.queued == len(b.send.hdrs) || len(p) > len(b.send.bufs[b.queued]) || len(oob) > len(b.send.oobs[b.queued]) {
+		return false
+	}
+	i := b.queued
+	namelen := putSockaddr(&b.send.names[i], rAddr, b.ipv4)
+	if namelen == 0 {
+		return false
+	}
+	hdr := &b.send.hdrs[i].hdr
+	hdr.Namelen = namelen
+	b.send.iovs[i].SetLen(copy(b.send.bufs[i], p))
+	hdr.SetControllen(copy(b.send.oobs[i], oob))
+	b.srcs[i], b.failed[i] = src, false
+	b.queued++
+	return true
+}
+func (b *batch) sendmmsg(fd uintptr) bool {
+	for b.sent < b.queued {
+		n, _, errno := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&b.send.hdrs[b.sent])), uintptr(b.queued-b.sent), syscall.MSG_DONTWAIT, 0, 0)
+		switch errno {
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			return false
+		case 0:
+			b.sent += int(n)
+		default:
+			// the first response failed, the others are still sent
+			if b.err == nil {
+				b.err = errno
+			}
+			b.failed[b.sent] = true
+			b.sent++
+		}
+	}
+	return true
+}
+
+// flush writes the queued responses, and hands those written to sent when
+// it is set.
+func (b *batch) flush(sent func(p []byte, src, rAddr netip.AddrPort)) error {
+	if b.queued == 0 {
+		return nil
+	}
+	b.sent, b.err = 0, nil
+	err := b.raw.Write(b.doSend)
+	n := b.sent
+	b.queued = 0
+	if sent != nil {
+		for i := 0; i < n; i++ {
+			if !b.failed[i] {
+				sent(b.send.bufs[i][:b.send.iovs[i].Len], b.srcs[i], sockaddrAddrPort(&b.send.names[i]))
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return b.err
+}
+
+// sockaddrAddrPort returns the address in sa like ReadFromUDPAddrPort, an
+// IPv4 address read from an AF_INET6 socket stays mapped.
+func sockaddrAddrPort(sa *syscall.RawSockaddrAny) netip.AddrPort {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), ntohs(sa4.Port))
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom16(sa6.Addr), ntohs(sa6.Port))
+	}
+	return netip.AddrPort{}
+}
+
+// putSockaddr writes addr to sa for a socket of the given family and
+// returns its length, 0 when the socket cannot send to it.
+func putSockaddr(sa *syscall.RawSockaddrAny, addr netip.AddrPort, ipv4 bool) uint32 {
+	ip := addr.Addr()
+	if ipv4 {
+		if ip = ip.Unmap(); !ip.Is4() {
+			return 0
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Port: ntohs(addr.Port()), Addr: ip.As4()}
+		return syscall.SizeofSockaddrInet4
+	}
+	if ip.Zone() != "" {
+		// the scope of a link-local address takes an interface lookup
+		return 0
+	}
+	sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+	*sa6 = syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Port: ntohs(addr.Port()), Addr: ip.As16()}
+	return syscall.SizeofSockaddrInet6
+}
+
+// ntohs swaps the bytes of a port in network order, and back, on the
+// little-endian architectures batches are built for.
+func ntohs(port uint16) uint16 {
+	return port<<8 | port>>8
+}
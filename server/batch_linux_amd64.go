@@ -0,0 +1,7 @@
+package server
+
+// recvmmsg(2) and sendmmsg(2), syscall lacks the latter.
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
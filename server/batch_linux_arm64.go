@@ -0,0 +1,8 @@
+package server
+
+import "syscall"
+
+const (
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+	sysSendmmsg = syscall.SYS_SENDMMSG
+)
@@ -0,0 +1,29 @@
+//go:build !linux || !(amd64 || arm64)
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// batch is only supported on Linux, elsewhere datagrams are read and
+// written one by one.
+type batch struct{}
+
+func newBatch(conn *net.UDPConn, size, oobSize int, ipv4 bool) (*batch, error) {
+	return nil, errors.New("batched packet i/o is only supported on linux")
+}
+func (b *batch) read() (int, error) {
+	return 0, errors.New("batched packet i/o is only supported on linux")
+}
+func (b *batch) message(i int) ([]byte, netip.AddrPort, []byte) {
+	return nil, netip.AddrPort{}, nil
+}
+func (b *batch) queue(p []byte, src, rAddr netip.AddrPort, oob []byte) bool {
+	return false
+}
+func (b *batch) flush(sent func(p []byte, src, rAddr netip.AddrPort)) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// listenAttempts bounds the retries of ListenGroup when a port picked by the
+// kernel on the primary IP is taken on the alternate one.
+const listenAttempts = 10
+
+// ListenGroup listens on the four sockets of an RFC 3489 server, the primary
+// and alternate IP each with the primary and alternate port, indexed like
+// ServeGroup expects. A port of 0 is picked by the kernel, the same on both
+// IPs. Without an alternate IP, the zero Addr, it only listens on the two
+// ports of the primary IP.
+func ListenGroup(primary, alternate netip.AddrPort) ([2][2]net.PacketConn, error) {
+	return listenGroupConfig(net.ListenConfig{}, primary, alternate)
+}
+func listenGroupConfig(lc net.ListenConfig, primary, alternate netip.AddrPort) (conns [2][2]net.PacketConn, err error) {
+	if !primary.Addr().IsValid() {
+		return conns, errors.New("primary address has no ip")
+	}
+	if (alternate.Addr().IsValid() && primary.Addr() == alternate.Addr()) || (primary.Port() == alternate.Port() && primary.Port() != 0) {
+		return conns, errors.New("alternate address must differ from the primary one in ip and port")
+	}
+	ips := [2]netip.Addr{primary.Addr(), alternate.Addr()}
+	ports := [2]uint16{primary.Port(), alternate.Port()}
+	for attempt := 0; attempt < listenAttempts; attempt++ {
+		conns, err = listenGroup(lc, ips, ports)
+		if err == nil || (ports[0] != 0 && ports[1] != 0) {
+			break
+		}
+	}
+	return conns, err
+}
+
+// listenGroupCopy listens on the addresses of the sockets of group again,
+// which needs them to set SO_REUSEPORT.
+func listenGroupCopy(lc net.ListenConfig, group [2][2]net.PacketConn) ([2][2]net.PacketConn, error) {
+	var ips [2]netip.Addr
+	var ports [2]uint16
+	for ip := range group {
+		for port := range group[ip] {
+			if conn := group[ip][port]; conn != nil {
+				addr := addrPort(conn.LocalAddr())
+				ips[ip], ports[port] = addr.Addr(), addr.Port()
+			}
+		}
+	}
+	return listenGroup(lc, ips, ports)
+}
+func listenGroup(lc net.ListenConfig, ips [2]netip.Addr, ports [2]uint16) (conns [2][2]net.PacketConn, err error) {
+	for port := range ports {
+		for ip := range ips {
+			if !ips[ip].IsValid() {
+				continue
+			}
+			var conn net.PacketConn
+			conn, err = lc.ListenPacket(context.Background(), "udp", netip.AddrPortFrom(ips[ip], ports[port]).String())
+			if err != nil {
+				closeGroup(conns)
+				return [2][2]net.PacketConn{}, err
+			}
+			conns[ip][port] = conn
+			ports[port] = addrPort(conn.LocalAddr()).Port()
+		}
+	}
+	return conns, nil
+}
+func closeGroup(conns [2][2]net.PacketConn) {
+	for _, row := range conns {
+		for _, conn := range row {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// ServeGroup answers the Binding Requests read from the four sockets of an
+// RFC 3489 server, conns[ip][port] with ip and port 0 for the primary and 1
+// for the alternate ones. A CHANGE-REQUEST is answered from the socket it
+// asks for, and each response carries the address of the socket it is sent
+// from in SOURCE-ADDRESS and that of the socket with the other IP and port in
+// CHANGED-ADDRESS, or the addresses they are advertised as. conns[0] are
+// reached on the PublicAddress and conns[1] on the AlternatePublicAddress.
+// The sockets of the alternate IP may be nil, requests to change the IP are
+// then not supported. It returns like Serve once any of the sockets fails,
+// after closing the others.
+func (s *Server) ServeGroup(conns [2][2]net.PacketConn) error {
+	errs := make(chan error, 4)
+	n := 0
+	for ip := range conns {
+		for port := range conns[ip] {
+			if conns[ip][port] == nil {
+				continue
+			}
+			h := baseHandler(s, conns[ip][port])
+			h.public[0], h.public[1] = s.public[ip], s.public[ip^1]
+			for changeIp := range h.peers {
+				for changePort := range h.peers[changeIp] {
+					if peer := conns[ip^changeIp][port^changePort]; peer != nil {
+						h.peers[changeIp][changePort] = peer
+						h.addrs[changeIp][changePort] = addrPort(peer.LocalAddr())
+					}
+				}
+			}
+			h.setChanged()
+			go func() { errs <- s.serve(h) }()
+			n++
+		}
+	}
+	if n == 0 {
+		return errors.New("no socket to serve")
+	}
+	err := <-errs
+	closeGroup(conns)
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// packetInfoSpace is the size of the control messages read and written with
+// a packet, enough for either family.
+var packetInfoSpace = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePacketInfo makes the kernel tell the destination address of every
+// packet read from conn, a socket of the given family.
+func enablePacketInfo(conn *net.UDPConn, ipv4 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parsePacketInfo returns the destination address in the control messages
+// read with a packet, without allocating.
+func parsePacketInfo(oob []byte) netip.Addr {
+	for len(oob) >= syscall.SizeofCmsghdr {
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		length := int(h.Len)
+		if length < syscall.SizeofCmsghdr || length > len(oob) {
+			break
+		}
+		data := oob[syscall.SizeofCmsghdr:length]
+		switch {
+		case h.Level == syscall.IPPROTO_IP && h.Type == syscall.IP_PKTINFO && len(data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			return netip.AddrFrom4(info.Addr)
+		case h.Level == syscall.IPPROTO_IPV6 && h.Type == syscall.IPV6_PKTINFO && len(data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			return netip.AddrFrom16(info.Addr).Unmap()
+		}
+		space := syscall.CmsgSpace(length - syscall.SizeofCmsghdr)
+		if space > len(oob) {
+			break
+		}
+		oob = oob[space:]
+	}
+	return netip.Addr{}
+}
+
+// appendPacketInfo appends a control message making a packet written to a
+// socket of the given family leave from src.
+func appendPacketInfo(oob []byte, src netip.Addr, ipv4 bool) []byte {
+	start := len(oob)
+	size := syscall.SizeofInet6Pktinfo
+	if ipv4 {
+		size = syscall.SizeofInet4Pktinfo
+	}
+	for i := 0; i < syscall.CmsgSpace(size); i++ {
+		oob = append(oob, 0)
+	}
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	h.SetLen(syscall.CmsgLen(size))
+	data := unsafe.Pointer(&oob[start+syscall.SizeofCmsghdr])
+	if ipv4 {
+		h.Level, h.Type = syscall.IPPROTO_IP, syscall.IP_PKTINFO
+		(*syscall.Inet4Pktinfo)(data).Spec_dst = src.As4()
+	} else {
+		h.Level, h.Type = syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO
+		(*syscall.Inet6Pktinfo)(data).Addr = src.As16()
+	}
+	return oob
+}
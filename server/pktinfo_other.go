@@ -0,0 +1,23 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var packetInfoSpace = 0
+
+// enablePacketInfo is only supported on Linux, elsewhere the kernel picks the
+// source of responses sent from a wildcard socket.
+func enablePacketInfo(conn *net.UDPConn, ipv4 bool) error {
+	return errors.New("destination address of packets is only supported on linux")
+}
+func parsePacketInfo(oob []byte) netip.Addr {
+	return netip.Addr{}
+}
+func appendPacketInfo(oob []byte, src netip.Addr, ipv4 bool) []byte {
+	return oob
+}
@@ -0,0 +1,31 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which syscall lacks on most architectures.
+const soReusePort = 0xf
+
+// reusePortSupported tells whether several sockets may share an address, the
+// kernel spreading the packets to it over them.
+const reusePortSupported = true
+
+// reusePortConfig returns a ListenConfig whose sockets set SO_REUSEPORT.
+func reusePortConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import "net"
+
+const reusePortSupported = false
+
+// reusePortConfig only spreads packets over sockets on Linux, where mips is
+// left out, elsewhere each address is read by a single socket.
+func reusePortConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"stun"
+	"stun/util"
+	"time"
+)
+
+// defaultCredentialLifetime is how long a USERNAME handed out in a Shared
+// Secret Response stays valid, RFC 3489 section 9.2 suggests ten minutes.
+const defaultCredentialLifetime = 10 * time.Minute
+
+// secretIssuer hands out credentials without keeping any state: the USERNAME
+// carries its expiry and an HMAC under a private key, and the PASSWORD is the
+// HMAC of the USERNAME under the same key.
+type secretIssuer struct {
+	key      []byte
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+// newSecretIssuer returns an issuer signing with key, a random one if empty.
+func newSecretIssuer(key []byte, lifetime time.Duration) (*secretIssuer, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &secretIssuer{key: key, lifetime: lifetime, now: time.Now}, nil
+}
+
+// issue returns a 40 character USERNAME and a 40 character PASSWORD, both
+// a multiple of 4 bytes as RFC 3489 requires.
+func (s *secretIssuer) issue() (username, password string, err error) {
+	prefix := make([]byte, 12)
+	binary.BigEndian.PutUint64(prefix, uint64(s.now().Add(s.lifetime).Unix()))
+	if _, err := rand.Read(prefix[8:]); err != nil {
+		return "", "", err
+	}
+	username = hex.EncodeToString(prefix) + hex.EncodeToString(util.HmacSha1(prefix, s.key)[:8])
+	return username, s.password(username), nil
+}
+func (s *secretIssuer) password(username string) string {
+	return hex.EncodeToString(util.HmacSha1([]byte(username), s.key))
+}
+
+// verify returns the PASSWORD of username if it was issued by s and has not
+// expired yet.
+func (s *secretIssuer) verify(username string) (string, bool) {
+	raw, err := hex.DecodeString(username)
+	if err != nil || len(raw) != 20 {
+		return "", false
+	}
+	prefix, mac := raw[:12], raw[12:]
+	if !hmac.Equal(mac, util.HmacSha1(prefix, s.key)[:8]) {
+		return "", false
+	}
+	if s.now().Unix() > int64(binary.BigEndian.Uint64(prefix)) {
+		return "", false
+	}
+	return s.password(username), true
+}
+
+// ServeSharedSecret answers Shared Secret Requests on connections accepted
+// from ln, which is expected to be a TLS listener, until ln fails or the
+// server is shut down, when it returns ErrServerClosed. ln is closed by
+// Shutdown.
+func (s *Server) ServeSharedSecret(ln net.Listener) error {
+	if !s.track(ln, s.listeners) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(ln, s.listeners)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn, s.tlsConns) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handleSharedSecretConn(conn)
+	}
+}
+func (s *Server) handleSharedSecretConn(conn net.Conn) {
+	defer s.untrack(conn, s.tlsConns)
+	defer conn.Close()
+	for !s.shuttingDown() {
+		conn.SetDeadline(time.Now().Add(s.config.IdleTimeout))
+		raw, err := stun.ReadRaw(conn)
+		if err != nil {
+			return
+		}
+		m, err := stun.ToMessage(raw)
+		if err != nil {
+			s.config.Logger.Printf("receive a malformed message from client,%v", err)
+			return
+		}
+		if s.config.LogMessages {
+			s.config.Logger.Printf("receive a message from client,%v", m.ToString())
+		}
+		if m.MessageType() != stun.ShareSecretReq {
+			continue
+		}
+		resp, err := s.newShareSecretResp(m)
+		if err != nil {
+			s.config.Logger.Printf("handle message failed,%v", err)
+			return
+		}
+		if s.config.LogMessages {
+			s.config.Logger.Printf("send a message to client,%v", resp.ToString())
+		}
+		if _, err := conn.Write(resp.ToRaw()); err != nil {
+			return
+		}
+	}
+}
+func (s *Server) newShareSecretResp(msg stun.OutMessage) (stun.InMessage, error) {
+	traId := msg.TransactionId()
+	if unknown := msg.UnknownComprehensionRequired(); len(unknown) > 0 {
+		return stun.NewShareSecretUnknownAttributesResponse(traId[:], unknown)
+	}
+	username, password, err := s.secrets.issue()
+	if err != nil {
+		return stun.NewShareSecretErrorResponse(traId[:], stun.CodeServerError, "")
+	}
+	return stun.NewShareSecretResponse(traId[:], username, password)
+}
@@ -1,102 +1,977 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math"
 	"net"
+	"net/netip"
+	"strings"
 	"stun"
+	"stun/pcap"
 	"stun/transform"
-	"stun/util"
-	"syscall"
+	"sync"
+	"time"
 )
 
-func Serve(address string) {
-	udpAddr, err := net.ResolveUDPAddr("udp", address)
+// ErrServerClosed is returned by the Serve methods and ListenAndServe after
+// Shutdown.
+var ErrServerClosed = errors.New("stun: server closed")
+
+const (
+	defaultAddress = ":3478"
+	// defaultIdleTimeout closes TLS connections on which the client stays
+	// idle.
+	defaultIdleTimeout = 30 * time.Second
+	// defaultBatchSize is the number of datagrams read, and responses
+	// written, by one syscall.
+	defaultBatchSize = 32
+	// defaultSlowPathQueue bounds the responses waiting for a slow path
+	// worker, those to a CHANGE-REQUEST spoofed through a raw socket.
+	defaultSlowPathQueue = 1024
+)
+
+// Config is the configuration of a Server.
+type Config struct {
+	// Addresses are the UDP addresses ListenAndServe listens on for Binding
+	// Requests, ":3478" if empty.
+	Addresses []string
+	// AlternateAddress is the other IP and port of the server. When set,
+	// ListenAndServe listens on the four combinations of the IPs and ports
+	// of it and the first of Addresses, see ServeGroup. Otherwise the next
+	// IPv4 address and port are claimed as the alternate address, and
+	// responses to a CHANGE-REQUEST are spoofed from them.
+	AlternateAddress string
+	// PublicAddress and AlternatePublicAddress are the IPs clients reach the
+	// IP of the first of Addresses and the alternate one on, when the server
+	// is behind a 1:1 NAT. Responses from the sockets of each carry them,
+	// with the port of the socket, in SOURCE-ADDRESS and CHANGED-ADDRESS.
+	PublicAddress          string
+	AlternatePublicAddress string
+	// AdvertisedAddresses maps the address a socket is bound to, or spoofs
+	// responses from, to the one clients reach it on, taking precedence over
+	// PublicAddress and AlternatePublicAddress. A key or value without port,
+	// "10.0.0.5", stands for every port of the IP, mapped to the same port.
+	AdvertisedAddresses map[string]string
+	// SharedSecretAddress is the TCP address ListenAndServe accepts Shared
+	// Secret Requests on when TLSConfig is set, the first of Addresses if
+	// empty.
+	SharedSecretAddress string
+	TLSConfig           *tls.Config
+	// SharedSecretKey signs the credentials handed out in Shared Secret
+	// Responses, servers configured with the same key accept each other's.
+	// A random key is used if empty.
+	SharedSecretKey []byte
+	// CredentialLifetime is how long those credentials stay valid, ten
+	// minutes if 0.
+	CredentialLifetime time.Duration
+
+	// RequireIntegrity rejects Binding Requests without MESSAGE-INTEGRITY
+	// with 401 Unauthorized.
+	RequireIntegrity bool
+	// LogMessages logs every message received and sent. Formatting them
+	// allocates, so a busy server should leave it off.
+	LogMessages bool
+	// Recorder, when set, records every message received and every response
+	// sent, including the raw packets answering a CHANGE-REQUEST.
+	Recorder *pcap.Recorder
+	// NoRawSocket never spoofs responses to a CHANGE-REQUEST through a raw IP
+	// socket, as if the process had no CAP_NET_RAW.
+	NoRawSocket bool
+	// RawSender, when set, spoofs the responses to a CHANGE-REQUEST and is
+	// left open by Shutdown. Otherwise the server uses
+	// transform.SharedSender, unless NoRawSocket is set.
+	RawSender transform.Sender
+	// Logger receives errors and messages, log.Default() if nil.
+	Logger *log.Logger
+
+	// Readers is the number of sockets ListenAndServe listens on each
+	// address with, sharing it through SO_REUSEPORT, each read by its own
+	// goroutine. 1 if 0, and on systems without SO_REUSEPORT.
+	Readers int
+	// BatchSize is the number of datagrams a socket reads with one
+	// recvmmsg(2) on Linux, the responses to them being written with one
+	// sendmmsg(2), 32 if 0. 1 reads and writes them one by one, as on other
+	// systems.
+	BatchSize int
+	// SlowPathWorkers is the number of goroutines sending responses that
+	// take a raw socket, so that they do not hold up the readers, 1 if 0.
+	// SlowPathQueue bounds the responses waiting for them, 1024 if 0, those
+	// coming once it is full are dropped.
+	SlowPathWorkers int
+	SlowPathQueue   int
+
+	// WriteTimeout bounds the time a response takes to be sent, 0 means no
+	// limit.
+	WriteTimeout time.Duration
+	// IdleTimeout closes TLS connections on which no request arrives, 30
+	// seconds if 0.
+	IdleTimeout time.Duration
+}
+
+// Server answers Binding Requests over UDP and Shared Secret Requests over
+// TLS.
+type Server struct {
+	config    Config
+	alternate netip.AddrPort
+	// sender spoofs responses, nil if it cannot
+	sender transform.Sender
+	// public are the IPs the primary and alternate IP are reached on and
+	// advertised those of the AdvertisedAddresses, port 0 for a whole IP.
+	public     [2]netip.Addr
+	advertised map[netip.AddrPort]netip.AddrPort
+	secrets    *secretIssuer
+
+	slow        chan spoofed // responses for the slow path workers
+	startSlow   sync.Once
+	stopSlow    sync.Once
+	slowWorkers sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[io.Closer]struct{} // UDP sockets and TLS listeners
+	tlsConns  map[io.Closer]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a server configured by config, which it keeps a copy of.
+func New(config Config) (*Server, error) {
+	s := &Server{
+		config:    config,
+		listeners: map[io.Closer]struct{}{},
+		tlsConns:  map[io.Closer]struct{}{},
+	}
+	if len(s.config.Addresses) == 0 {
+		s.config.Addresses = []string{defaultAddress}
+	}
+	if s.config.SharedSecretAddress == "" {
+		s.config.SharedSecretAddress = s.config.Addresses[0]
+	}
+	if s.config.Logger == nil {
+		s.config.Logger = log.Default()
+	}
+	if s.config.IdleTimeout == 0 {
+		s.config.IdleTimeout = defaultIdleTimeout
+	}
+	if s.config.CredentialLifetime <= 0 {
+		s.config.CredentialLifetime = defaultCredentialLifetime
+	}
+	secrets, err := newSecretIssuer(s.config.SharedSecretKey, s.config.CredentialLifetime)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	s.secrets = secrets
+	if s.config.Readers <= 0 {
+		s.config.Readers = 1
+	}
+	if s.config.Readers > 1 && !reusePortSupported {
+		s.config.Logger.Printf("no SO_REUSEPORT, every address is read by a single socket")
+		s.config.Readers = 1
+	}
+	if s.config.BatchSize <= 0 {
+		s.config.BatchSize = defaultBatchSize
+	}
+	if s.config.SlowPathWorkers <= 0 {
+		s.config.SlowPathWorkers = 1
+	}
+	if s.config.SlowPathQueue <= 0 {
+		s.config.SlowPathQueue = defaultSlowPathQueue
+	}
+	s.slow = make(chan spoofed, s.config.SlowPathQueue)
+	if s.config.AlternateAddress != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", s.config.AlternateAddress)
+		if err != nil {
+			return nil, err
+		}
+		s.alternate = udpAddr.AddrPort()
+	}
+	for i, address := range []string{s.config.PublicAddress, s.config.AlternatePublicAddress} {
+		if address == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, err
+		}
+		s.public[i] = addr.Unmap()
+	}
+	if len(s.config.AdvertisedAddresses) > 0 {
+		s.advertised = make(map[netip.AddrPort]netip.AddrPort, len(s.config.AdvertisedAddresses))
+		for local, public := range s.config.AdvertisedAddresses {
+			localAddr, err := parseAdvertised(local)
+			if err != nil {
+				return nil, err
+			}
+			publicAddr, err := parseAdvertised(public)
+			if err != nil {
+				return nil, err
+			}
+			s.advertised[localAddr] = publicAddr
+		}
 	}
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+	switch {
+	case s.config.NoRawSocket:
+	case s.config.RawSender != nil:
+		s.sender = s.config.RawSender
+	default:
+		sender, err := transform.SharedSender()
+		if err != nil {
+			s.config.Logger.Printf("no raw socket, change requests are only answered from real sockets,%v", err)
+		}
+		s.sender = sender
+	}
+	return s, nil
+}
+
+// parseAdvertised parses an address of AdvertisedAddresses, an IP without
+// port has port 0.
+func parseAdvertised(address string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0), nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
 	if err != nil {
-		log.Fatal(err)
+		return netip.AddrPort{}, err
 	}
-	defer udpConn.Close()
-	log.Printf("%s%s", "listen on ", address)
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), nil
+}
+
+// unspecified returns the unspecified address of the family of like, the
+// IPv6 one, which also accepts IPv4, if like is not valid.
+func unspecified(like netip.Addr) netip.Addr {
+	if like.Unmap().Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+// ListenAndServe listens on the configured addresses and serves them until
+// ctx is done, when it shuts the server down and returns ctx.Err(), or until
+// one of them fails, when it shuts the server down and returns the error.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	// conns[i] are the sockets of the i-th address, but for the first when
+	// it is served as a group, the sockets of which are in groups
+	conns := make([][]net.PacketConn, len(s.config.Addresses))
+	var groups [][2][2]net.PacketConn
+	var ln net.Listener
+	closeAll := func() {
+		for _, group := range groups {
+			closeGroup(group)
+		}
+		for _, readers := range conns {
+			for _, conn := range readers {
+				conn.Close()
+			}
+		}
+	}
+	lc := net.ListenConfig{}
+	if s.config.Readers > 1 {
+		lc = reusePortConfig()
+	}
+	for i, address := range s.config.Addresses {
+		if i == 0 && (s.alternate.IsValid() || s.sender == nil) {
+			udpAddr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				return err
+			}
+			primary := udpAddr.AddrPort()
+			if !primary.Addr().IsValid() {
+				// no host, like ":3478", listens on every IP of the family
+				// of the alternate address, or of both families
+				primary = netip.AddrPortFrom(unspecified(s.alternate.Addr()), primary.Port())
+			}
+			alternate := s.alternate
+			if !alternate.IsValid() {
+				// without an alternate IP a real socket on the next port
+				// still answers requests to change the port
+				port := primary.Port()
+				if port != 0 {
+					port++
+				}
+				alternate = netip.AddrPortFrom(netip.Addr{}, port)
+			}
+			group, err := listenGroupConfig(lc, primary, alternate)
+			if err != nil && !s.alternate.IsValid() && alternate.Port() != 0 {
+				// the next port is taken, let the kernel pick one
+				group, err = listenGroupConfig(lc, primary, netip.AddrPort{})
+			}
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+			for len(groups) < s.config.Readers {
+				group, err := listenGroupCopy(lc, groups[0])
+				if err != nil {
+					closeAll()
+					return err
+				}
+				groups = append(groups, group)
+			}
+			continue
+		}
+		for len(conns[i]) < s.config.Readers {
+			if len(conns[i]) > 0 {
+				address = conns[i][0].LocalAddr().String()
+			}
+			conn, err := lc.ListenPacket(context.Background(), "udp", address)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			conns[i] = append(conns[i], conn)
+		}
+	}
+	if s.config.TLSConfig != nil {
+		var err error
+		ln, err = tls.Listen("tcp", s.config.SharedSecretAddress, s.config.TLSConfig)
+		if err != nil {
+			closeAll()
+			return err
+		}
+	}
+
+	errs := make(chan error, len(groups)+len(conns)*s.config.Readers+1)
+	for _, group := range groups {
+		for _, row := range group {
+			for _, conn := range row {
+				if conn != nil {
+					s.config.Logger.Printf("%s%s", "listen on ", conn.LocalAddr())
+				}
+			}
+		}
+		go func(group [2][2]net.PacketConn) { errs <- s.ServeGroup(group) }(group)
+	}
+	for i, readers := range conns {
+		for _, conn := range readers {
+			s.config.Logger.Printf("%s%s", "listen on ", conn.LocalAddr())
+			h := newHandler(s, conn)
+			if i == 0 {
+				// the first of Addresses, spoofing the alternate address
+				h.public = s.public
+			}
+			go func() { errs <- s.serve(h) }()
+		}
+	}
+	if ln != nil {
+		s.config.Logger.Printf("%s%s", "listen shared secret on ", ln.Addr())
+		go func() { errs <- s.ServeSharedSecret(ln) }()
+	}
+	select {
+	case err := <-errs:
+		s.Shutdown(context.Background())
+		return err
+	case <-ctx.Done():
+		s.Shutdown(context.Background())
+		return ctx.Err()
+	}
+}
+
+// Serve answers the Binding Requests read from conn until conn fails or the
+// server is shut down, when it returns ErrServerClosed. conn is closed by
+// Shutdown.
+func (s *Server) Serve(conn net.PacketConn) error {
+	return s.serve(newHandler(s, conn))
+}
+func (s *Server) serve(h *handler) error {
+	conn := h.conn
+	if !s.track(conn, s.listeners) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(conn, s.listeners)
+	s.startSlow.Do(func() {
+		for i := 0; i < s.config.SlowPathWorkers; i++ {
+			s.slowWorkers.Add(1)
+			go s.slowPath()
+		}
+	})
+	s.config.Logger.Print(h.capabilities())
 	buf := make([]byte, 1500)
 	for {
-		n, rUdpAddr, err := udpConn.ReadFromUDP(buf)
+		if err := h.serveOnce(buf); err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// Shutdown stops the server: it closes the sockets and listeners, waits for
+// the requests being handled to be answered and TLS connections to be done,
+// and returns nil, or ctx.Err() if ctx is done first, closing the TLS
+// connections left.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	// interrupt the connections waiting for a request, a response being
+	// written is not affected
+	for conn := range s.tlsConns {
+		conn.(net.Conn).SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		// no reader is left to queue responses for the slow path
+		s.stopSlow.Do(func() {
+			close(s.slow)
+			s.slowWorkers.Wait()
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.tlsConns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// track adds c to set, unless the server is shut down.
+func (s *Server) track(c io.Closer, set map[io.Closer]struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	set[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+func (s *Server) untrack(c io.Closer, set map[io.Closer]struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(set, c)
+	s.wg.Done()
+}
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// handler answers the requests read from one socket. It keeps the decoded
+// request, the response and the output buffer between requests, so that a
+// plain Binding Request is answered without allocating.
+type handler struct {
+	s     *Server
+	conn  net.PacketConn
+	udp   *net.UDPConn // conn, when it is one, read and written without allocating
+	lAddr netip.AddrPort
+	// peers are the sockets responses are sent from, relative to conn, and
+	// addrs their addresses: [1][0] has the other IP, [0][1] the other port
+	// and [0][0] is conn. Responses from an address without a socket are
+	// spoofed through a raw socket, a CHANGE-REQUEST for an address that is
+	// not valid is not supported. An unspecified IP is resolved per request,
+	// see source.
+	peers [2][2]net.PacketConn
+	addrs [2][2]netip.AddrPort
+	// derive makes the spoofed addrs[1] of a lone wildcard socket derived
+	// from the destination of each request.
+	derive bool
+	// public are the IPs peers[0] and peers[1] are reached on, if known.
+	public [2]netip.Addr
+	// changedAt indexes the addrs sent in CHANGED-ADDRESS: [1][1], or the
+	// address closest to it the server has.
+	changedAt [2]int
+	// pktinfo is set when conn is a wildcard socket the kernel tells the
+	// destination of each packet read from, dst, in oob. Responses then
+	// leave from dst, set with the control message in woob.
+	pktinfo bool
+	dst     netip.Addr
+	oob     []byte
+	woob    []byte
+	// batch reads and writes the datagrams of conn, when set, those written
+	// to it while batching are queued until the whole batch is handled.
+	batch    *batch
+	batching bool
+	// sent records the responses flushed by batch, nil without a Recorder
+	sent func(p []byte, src, rAddr netip.AddrPort)
+	req  stun.Message
+	resp stun.Message
+	out  []byte
+}
+
+// newHandler returns the handler of a lone socket. With a raw socket its
+// responses to a CHANGE-REQUEST are spoofed from the configured alternate
+// address or one derived from its own, they are not supported otherwise.
+func newHandler(s *Server, conn net.PacketConn) *handler {
+	h := baseHandler(s, conn)
+	h.peers[0][0], h.addrs[0][0] = conn, h.lAddr
+	if s.sender != nil && (h.lAddr.Addr().Unmap().Is4() || h.pktinfo) {
+		alternate := s.alternate
+		if !alternate.IsValid() {
+			alternate = derivedAlternate(h.lAddr)
+			h.derive = h.lAddr.Addr().IsUnspecified()
+		}
+		h.addrs[0][1] = netip.AddrPortFrom(h.lAddr.Addr(), alternate.Port())
+		h.addrs[1][0] = netip.AddrPortFrom(alternate.Addr(), h.lAddr.Port())
+		h.addrs[1][1] = alternate
+	}
+	h.setChanged()
+	return h
+}
+
+// baseHandler returns a handler of conn without peers.
+func baseHandler(s *Server, conn net.PacketConn) *handler {
+	h := &handler{s: s, conn: conn, out: make([]byte, 0, 1500)}
+	h.udp, _ = conn.(*net.UDPConn)
+	h.lAddr = addrPort(conn.LocalAddr())
+	if h.udp != nil && h.lAddr.Addr().IsUnspecified() {
+		if err := enablePacketInfo(h.udp, h.lAddr.Addr().Is4()); err != nil {
+			s.config.Logger.Printf("responses from %s leave from the address the kernel picks,%v", h.lAddr, err)
+		} else {
+			h.pktinfo = true
+			h.oob = make([]byte, packetInfoSpace)
+			h.woob = make([]byte, 0, packetInfoSpace)
+		}
+	}
+	if h.udp != nil && s.config.BatchSize > 1 {
+		var err error
+		h.batch, err = newBatch(h.udp, s.config.BatchSize, len(h.oob), h.lAddr.Addr().Is4())
 		if err != nil {
-			log.Fatal(err)
+			s.config.Logger.Printf("datagrams of %s are read one by one,%v", h.lAddr, err)
 		}
-		if stun.IsMessage(buf[:n]) {
-			m, err := stun.ToMessage(buf[:n])
-			if err != nil {
-				log.Fatal(err)
-			} else {
-				log.Printf("receive a message from client,%v", m.ToString())
-				switch m.MessageType() {
-				case stun.BindReq:
-					handleBindReq(udpConn, rUdpAddr, m)
-				case stun.ShareSecretReq:
-					handleShareSecretReq(udpConn, m)
+		if s.config.Recorder != nil {
+			h.sent = h.recordSent
+		}
+	}
+	return h
+}
+func (h *handler) setChanged() {
+	for _, at := range [][2]int{{1, 1}, {1, 0}, {0, 1}} {
+		if h.addrs[at[0]][at[1]].IsValid() {
+			h.changedAt = at
+			return
+		}
+	}
+	h.changedAt = [2]int{0, 0}
+}
+
+// source returns the address a response sent from peers[changeIp][changePort]
+// leaves from. A wildcard socket of the IP the request was sent to sends from
+// that address, one of the other IP from the address derived from it, or
+// from its unspecified address when the destination of the request is not
+// known.
+func (h *handler) source(changeIp, changePort int) netip.AddrPort {
+	addr := h.addrs[changeIp][changePort]
+	if !addr.Addr().IsUnspecified() || !h.dst.IsValid() {
+		return addr
+	}
+	switch {
+	case changeIp == 0:
+		return netip.AddrPortFrom(h.dst, addr.Port())
+	case h.derive:
+		return netip.AddrPortFrom(derivedAlternate(netip.AddrPortFrom(h.dst, 0)).Addr(), addr.Port())
+	}
+	return addr
+}
+
+// advertised returns the address clients reach addr on, the source of a
+// response sent from peers[changeIp][changePort].
+func (h *handler) advertised(changeIp, changePort int, addr netip.AddrPort) netip.AddrPort {
+	if len(h.s.advertised) > 0 {
+		for _, local := range [...]netip.AddrPort{
+			h.addrs[changeIp][changePort],
+			addr,
+			netip.AddrPortFrom(addr.Addr().Unmap(), 0),
+		} {
+			if public, ok := h.s.advertised[local]; ok {
+				if public.Port() == 0 {
+					return netip.AddrPortFrom(public.Addr(), addr.Port())
 				}
+				return public
 			}
 		}
 	}
+	if public := h.public[changeIp]; public.IsValid() && addr.IsValid() {
+		return netip.AddrPortFrom(public, addr.Port())
+	}
+	return addr
+}
 
+// capabilities describes the requests of the tests of RFC 3489 section 10.1
+// the socket can answer, and how.
+func (h *handler) capabilities() string {
+	var b strings.Builder
+	b.WriteString(h.lAddr.String())
+	if public := h.advertised(0, 0, h.lAddr); public != h.lAddr {
+		fmt.Fprintf(&b, " advertised as %s", public)
+	}
+	if h.pktinfo {
+		b.WriteString(" (responses from the address requests are sent to)")
+	}
+	for _, test := range []struct {
+		name                 string
+		changeIp, changePort int
+	}{
+		{"test II (change ip and port)", 1, 1},
+		{"test III (change port)", 0, 1},
+		{"change ip", 1, 0},
+	} {
+		fmt.Fprintf(&b, ", %s: ", test.name)
+		addr := h.addrs[test.changeIp][test.changePort]
+		switch {
+		case h.peers[test.changeIp][test.changePort] != nil:
+			fmt.Fprintf(&b, "from %s", addr)
+		case addr.IsValid():
+			fmt.Fprintf(&b, "spoofing %s", addr)
+		default:
+			b.WriteString("unsupported")
+			continue
+		}
+		if public := h.advertised(test.changeIp, test.changePort, addr); public != addr {
+			fmt.Fprintf(&b, " advertised as %s", public)
+		}
+	}
+	return b.String()
 }
-func handleBindReq(udpConn *net.UDPConn, rUdpAddr *net.UDPAddr, msg stun.OutMessage) error {
-	traId := msg.TransactionId()
-	resp, err := stun.NewBindResponse(traId[:], rUdpAddr.String(), udpConn.LocalAddr().String(), rUdpAddr.String())
-	if err != nil {
-		log.Fatal(err)
+
+// derivedAlternate is the address a lone socket on lAddr claims to have as
+// its alternate one: the next IPv4 address, .254 wrapping to .1, and the next
+// port.
+func derivedAlternate(lAddr netip.AddrPort) netip.AddrPort {
+	ip := lAddr.Addr().Unmap()
+	if ip.Is4() {
+		b := ip.As4()
+		b[3] = b[3]%254 + 1
+		ip = netip.AddrFrom4(b)
 	}
-	av := msg.GetAttribute(stun.AttrChangeRequest)
-	if av == nil {
-		av = [2]bool{false, false}
+	port := lAddr.Port() + 1
+	if port == 0 {
+		port = 1
 	}
-	cip := av.([2]bool)
+	return netip.AddrPortFrom(ip, port)
+}
 
-	if !cip[0] && !cip[1] {
-		log.Printf("send a message to client,%v", resp.ToString())
-		udpConn.WriteToUDP(resp.ToRaw(), rUdpAddr)
-	} else {
-		sAddr := udpConn.LocalAddr().(*net.UDPAddr)
-		port := sAddr.Port
-		sIp := make([]byte, len(sAddr.IP))
-		copy(sIp, sAddr.IP)
-		if cip[0] {
-			len := len(sIp)
-			sIp[len-1] = ((sIp[len-1] + 1) % 254) + 1
-		}
-		if cip[1] {
-			port = (port + 1) % math.MaxInt8
-		}
-		srcIp, dstIp := util.Ip2l(sIp), util.Ip2l(rUdpAddr.IP)
-		//log.Printf("srcIp:%v,dstIp:%v,sport:%v,dport:%v", sAddr.IP, rUdpAddr.IP, port, rUdpAddr.Port)
-		udpPkg, err := transform.NewUdpPackage(srcIp, dstIp, uint16(port), uint16(rUdpAddr.Port), resp.ToRaw())
+// index converts a CHANGE-REQUEST flag to an index of peers.
+func index(change bool) int {
+	if change {
+		return 1
+	}
+	return 0
+}
+
+// addrPort converts addr, the zero AddrPort if it is not an IP address.
+func addrPort(addr net.Addr) netip.AddrPort {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort()
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort
+}
+
+// serveOnce reads and answers a datagram, or a batch of them, and only
+// returns the errors of reads.
+func (h *handler) serveOnce(buf []byte) error {
+	if h.batch == nil {
+		n, rAddr, err := h.readFrom(buf)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		ipPkg, err := transform.NewIpPackage(srcIp, dstIp, udpPkg.ToRaw())
-		if err != nil {
-			log.Fatal(err)
+		h.handleFrom(buf[:n], rAddr)
+		return nil
+	}
+	n, err := h.batch.read()
+	if err != nil {
+		return err
+	}
+	h.batching = true
+	for i := 0; i < n; i++ {
+		raw, rAddr, oob := h.batch.message(i)
+		if h.pktinfo {
+			h.dst = parsePacketInfo(oob)
+		}
+		h.handleFrom(raw, rAddr)
+	}
+	h.batching = false
+	if h.s.config.WriteTimeout > 0 {
+		h.conn.SetWriteDeadline(time.Now().Add(h.s.config.WriteTimeout))
+	}
+	if err := h.batch.flush(h.sent); err != nil {
+		h.s.config.Logger.Printf("send responses failed,%v", err)
+	}
+	return nil
+}
+func (h *handler) handleFrom(raw []byte, rAddr netip.AddrPort) {
+	if !rAddr.IsValid() {
+		return
+	}
+	if err := h.handle(raw, rAddr); err != nil {
+		h.s.config.Logger.Printf("handle message failed,%v", err)
+	}
+}
+func (h *handler) readFrom(buf []byte) (int, netip.AddrPort, error) {
+	if h.pktinfo {
+		n, oobn, _, rAddr, err := h.udp.ReadMsgUDPAddrPort(buf, h.oob)
+		h.dst = parsePacketInfo(h.oob[:oobn])
+		return n, rAddr, err
+	}
+	if h.udp != nil {
+		return h.udp.ReadFromUDPAddrPort(buf)
+	}
+	n, addr, err := h.conn.ReadFrom(buf)
+	if err != nil {
+		return n, netip.AddrPort{}, err
+	}
+	return n, addrPort(addr), nil
+}
+
+// writeTo sends b from conn, whose address is lAddr, leaving from src.
+func (h *handler) writeTo(conn net.PacketConn, lAddr, src netip.AddrPort, b []byte, rAddr netip.AddrPort) error {
+	if h.batching && conn == h.conn {
+		var oob []byte
+		if src.Addr() != lAddr.Addr() {
+			oob = appendPacketInfo(h.woob[:0], src.Addr(), lAddr.Addr().Is4())
+		}
+		// recorded once flushed
+		if h.batch.queue(b, src, rAddr, oob) {
+			return nil
+		}
+	}
+	if h.s.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(h.s.config.WriteTimeout))
+	}
+	var err error
+	udp, ok := conn.(*net.UDPConn)
+	switch {
+	case ok && src.Addr() != lAddr.Addr():
+		h.woob = appendPacketInfo(h.woob[:0], src.Addr(), lAddr.Addr().Is4())
+		_, _, err = udp.WriteMsgUDPAddrPort(b, h.woob, rAddr)
+	case ok:
+		_, err = udp.WriteToUDPAddrPort(b, rAddr)
+	default:
+		_, err = conn.WriteTo(b, net.UDPAddrFromAddrPort(rAddr))
+	}
+	if err == nil {
+		h.recordSent(b, src, rAddr)
+	}
+	return err
+}
+func (h *handler) handle(raw []byte, rAddr netip.AddrPort) error {
+	if !stun.IsMessage(raw) {
+		return nil
+	}
+	if recorder := h.s.config.Recorder; recorder != nil {
+		h.record(recorder.RecordUDP(time.Now(), rAddr, h.source(0, 0), raw))
+	}
+	if err := h.req.Decode(raw); err != nil {
+		h.s.config.Logger.Printf("receive a malformed message from client,%v", err)
+		if traId, ok := bindReqTransactionId(raw); ok {
+			return h.sendErrorResp(rAddr, traId, stun.CodeBadRequest)
 		}
+		return nil
+	}
+	if h.s.config.LogMessages {
+		h.s.config.Logger.Printf("receive a message from client,%v", h.req.ToString())
+	}
+	switch h.req.MessageType() {
+	case stun.BindReq:
+		return h.handleBindReq(rAddr)
+	case stun.ShareSecretReq:
+		return h.handleShareSecretReq(rAddr)
+	}
+	return nil
+}
 
-		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+// bindReqTransactionId returns the transaction id of a Binding Request that
+// stun.ToMessage rejected, so that the client can still be told about it.
+func bindReqTransactionId(raw []byte) ([]byte, bool) {
+	if len(raw) < 20 || stun.MessageType(uint16(raw[0])<<8|uint16(raw[1])) != stun.BindReq {
+		return nil, false
+	}
+	return raw[4:20], true
+}
+func (h *handler) sendErrorResp(rAddr netip.AddrPort, traId []byte, code stun.ErrorCode) error {
+	resp, err := stun.NewBindErrorResponse(traId, code, "")
+	if err != nil {
+		return err
+	}
+	return h.sendResp(rAddr, resp, nil)
+}
+func (h *handler) sendResp(rAddr netip.AddrPort, resp stun.InMessage, key []byte) error {
+	return h.sendRespFrom(0, 0, rAddr, resp, key)
+}
+
+// sendRespFrom sends resp from peers[changeIp][changePort].
+func (h *handler) sendRespFrom(changeIp, changePort int, rAddr netip.AddrPort, resp stun.InMessage, key []byte) error {
+	if h.s.config.LogMessages {
+		h.s.config.Logger.Printf("send a message to client,%v", resp.ToString())
+	}
+	h.out = encode(h.out[:0], resp, key)
+	src := h.source(changeIp, changePort)
+	return h.writeTo(h.peers[changeIp][changePort], h.addrs[changeIp][changePort], src, h.out, rAddr)
+}
+
+// recordSent records the response p sent from src to rAddr.
+func (h *handler) recordSent(p []byte, src, rAddr netip.AddrPort) {
+	if recorder := h.s.config.Recorder; recorder != nil {
+		h.record(recorder.RecordUDP(time.Now(), src, rAddr, p))
+	}
+}
+
+// record logs a failure to record a packet, which must not keep the server
+// from answering.
+func (h *handler) record(err error) {
+	if err != nil {
+		h.s.config.Logger.Printf("record packet failed,%v", err)
+	}
+}
+
+// encode appends resp to buf, signing it when the request was authenticated
+// with key.
+func encode(buf []byte, resp stun.InMessage, key []byte) []byte {
+	if key == nil {
+		return resp.Encode(buf)
+	}
+	return resp.EncodeWithIntegrity(buf, key)
+}
+
+// authenticate returns the error code a Binding Request must be rejected
+// with, or 0 and the key the response must be signed with (nil if the
+// request did not carry MESSAGE-INTEGRITY).
+func (s *Server) authenticate(msg stun.OutMessage) ([]byte, stun.ErrorCode) {
+	if !msg.Contains(stun.AttrMessageIntegrity) {
+		if s.config.RequireIntegrity {
+			return nil, stun.CodeUnauthorized
+		}
+		return nil, 0
+	}
+	username, ok := msg.Username()
+	if !ok {
+		return nil, stun.CodeMissingUsername
+	}
+	password, ok := s.secrets.verify(username)
+	if !ok {
+		return nil, stun.CodeStaleCredentials
+	}
+	if msg.VerifyIntegrity([]byte(password)) != nil {
+		return nil, stun.CodeIntegrityCheckFailure
+	}
+	return []byte(password), 0
+}
+func (h *handler) handleBindReq(rAddr netip.AddrPort) error {
+	msg := &h.req
+	traId := msg.TransactionId()
+	key, code := h.s.authenticate(msg)
+	if code != 0 {
+		return h.sendErrorResp(rAddr, traId[:], code)
+	}
+	if unknown := msg.UnknownComprehensionRequired(); len(unknown) > 0 {
+		resp, err := stun.NewBindUnknownAttributesResponse(traId[:], unknown)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		defer syscall.Shutdown(fd, syscall.SHUT_RDWR)
-		var dst syscall.SockaddrInet4
-		dst.Addr[0], dst.Addr[1], dst.Addr[2], dst.Addr[3] = rUdpAddr.IP[0], rUdpAddr.IP[1], rUdpAddr.IP[2], rUdpAddr.IP[3]
-		log.Printf("send a message to client,%v", resp.ToString())
-		err = syscall.Sendto(fd, ipPkg.ToRaw(), 0, &dst)
+		return h.sendResp(rAddr, resp, nil)
+	}
+	changeIp, changePort, _ := msg.ChangeRequest()
+	ci, cp := index(changeIp), index(changePort)
+	sAddr := h.source(ci, cp)
+	if !sAddr.IsValid() {
+		resp, err := stun.NewBindUnknownAttributesResponse(traId[:], []stun.AttrType{stun.AttrChangeRequest})
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		return h.sendResp(rAddr, resp, nil)
+	}
+	// behind a NAT the attributes carry the addresses clients reach, the
+	// response still leaves from sAddr
+	source := h.advertised(ci, cp, sAddr)
+	changed := h.advertised(h.changedAt[0], h.changedAt[1], h.source(h.changedAt[0], h.changedAt[1]))
+	// a RESPONSE-ADDRESS could make the server flood a third party, so it is
+	// only honored for authenticated requests (RFC 3489 section 12.1)
+	respAddr := rAddr
+	var resp stun.InMessage = &h.resp
+	var err error
+	if msg.Contains(stun.AttrResponseAddress) {
+		if key == nil {
+			return h.sendErrorResp(rAddr, traId[:], stun.CodeUnauthorized)
+		}
+		address, ok := msg.ResponseAddress()
+		if !ok {
+			return h.sendErrorResp(rAddr, traId[:], stun.CodeBadRequest)
+		}
+		respAddr = address.AddrPort()
+		rUdpAddr := net.UDPAddrFromAddrPort(rAddr).String()
+		changedAddr := net.UDPAddrFromAddrPort(changed).String()
+		resp, err = stun.NewReflectedBindResponse(traId[:], rUdpAddr, source.String(), changedAddr, rUdpAddr)
+	} else {
+		err = h.resp.SetBindResponse(traId, rAddr, source, changed)
+	}
+	if err != nil {
+		h.sendErrorResp(rAddr, traId[:], stun.CodeServerError)
+		return err
+	}
+	if h.peers[ci][cp] != nil {
+		return h.sendRespFrom(ci, cp, respAddr, resp, key)
+	}
+	if !sAddr.Addr().Unmap().Is4() || !respAddr.Addr().Unmap().Is4() {
+		h.sendErrorResp(rAddr, traId[:], stun.CodeServerError)
+		return errors.New("change request is only supported for ipv4")
+	}
+	if h.s.config.LogMessages {
+		h.s.config.Logger.Printf("send a message to client,%v", resp.ToString())
+	}
+	select {
+	case h.s.slow <- spoofed{src: sAddr, dst: respAddr, payload: encode(nil, resp, key)}:
+		return nil
+	default:
+		return errors.New("slow path queue full, response to change request dropped")
 	}
-	return nil
 }
-func handleShareSecretReq(udpConn *net.UDPConn, msg stun.OutMessage) error {
+
+// spoofed is a response sent from an address the server has no socket on.
+type spoofed struct {
+	src, dst netip.AddrPort
+	payload  []byte
+}
+
+// slowPath sends the spoofed responses queued by the readers until Shutdown.
+func (s *Server) slowPath() {
+	defer s.slowWorkers.Done()
+	for resp := range s.slow {
+		if err := s.spoof(resp); err != nil {
+			s.config.Logger.Printf("send spoofed response failed,%v", err)
+		}
+	}
+}
+
+// spoof sends resp through the raw sender.
+func (s *Server) spoof(resp spoofed) error {
+	if err := s.sender.SendUDP(resp.src, resp.dst, resp.payload); err != nil {
+		return err
+	}
+	if recorder := s.config.Recorder; recorder != nil {
+		if err := recorder.RecordUDP(time.Now(), resp.src, resp.dst, resp.payload); err != nil {
+			s.config.Logger.Printf("record packet failed,%v", err)
+		}
+	}
 	return nil
 }
+
+// handleShareSecretReq turns away Shared Secret Requests sent over UDP, they
+// must be sent over TLS to ServeSharedSecret.
+func (h *handler) handleShareSecretReq(rAddr netip.AddrPort) error {
+	traId := h.req.TransactionId()
+	resp, err := stun.NewShareSecretErrorResponse(traId[:], stun.CodeUseTLS, "")
+	if err != nil {
+		return err
+	}
+	return h.sendResp(rAddr, resp, nil)
+}
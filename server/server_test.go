@@ -1,15 +1,187 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"stun"
+	"stun/pcap"
 	"stun/transform"
 	"stun/util"
 	"syscall"
 	"testing"
+	"time"
 )
 
+// serveConn serves conn with a server configured by config until the test
+// ends.
+func serveConn(t testing.TB, conn net.PacketConn, config Config) *Server {
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
 func TestServe(t *testing.T) {
-	Serve("0.0.0.0:3478")
+	for _, config := range []Config{
+		{Addresses: []string{"127.0.0.1:0", "127.0.0.1:0"}},
+		{Addresses: []string{"127.0.0.1:0"}, AlternateAddress: "127.0.0.2:0"},
+		{Addresses: []string{"127.0.0.1:0", "127.0.0.1:0"}, NoRawSocket: true, Readers: 4},
+	} {
+		s, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error)
+		go func() { errs <- s.ListenAndServe(ctx) }()
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errs:
+			if err != context.Canceled {
+				t.Fatalf("ListenAndServe returned %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ListenAndServe did not return")
+		}
+	}
+
+	if _, err := New(Config{AlternateAddress: "not an address", NoRawSocket: true}); err == nil {
+		t.Fatal("accepted an invalid alternate address")
+	}
+	s, err := New(Config{Addresses: []string{"127.0.0.1:0", "not an address"}, NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ListenAndServe(context.Background()); err == nil {
+		t.Fatal("listened on an invalid address")
+	}
+}
+
+func TestServeNoHost(t *testing.T) {
+	// a free port, the next one taken or not
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+	s, err := New(Config{Addresses: []string{fmt.Sprintf(":%d", port)}, NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- s.ListenAndServe(ctx) }()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	for attempt := 0; ; attempt++ {
+		select {
+		case err := <-errs:
+			t.Fatalf("ListenAndServe returned %v", err)
+		default:
+		}
+		client.WriteToUDP(req.ToRaw(), to)
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := client.Read(buf)
+		if err != nil {
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+			continue
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.MessageType() != stun.BindResp {
+			t.Fatalf("got %s", m.ToString())
+		}
+		break
+	}
+
+	if _, err := ListenGroup(netip.AddrPortFrom(netip.Addr{}, 0), netip.AddrPort{}); err == nil {
+		t.Error("listened on a group without primary ip")
+	}
+}
+func TestShutdown(t *testing.T) {
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- s.Serve(udpConn) }()
+	go func() { errs <- s.ServeSharedSecret(ln) }()
+	// an idle connection must not hold Shutdown up
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a request answered on the way in
+	client, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write(req.ToRaw())
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrServerClosed {
+			t.Fatalf("serve returned %v", err)
+		}
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection left open")
+	}
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(other); err != ErrServerClosed {
+		t.Fatalf("Serve after Shutdown returned %v", err)
+	}
 }
 
 func TestRawSocket(t *testing.T) {
@@ -24,13 +196,1199 @@ func TestRawSocket(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_IPV4)
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
 	if err != nil {
-		log.Fatal(err)
+		t.Skip(err)
 	}
+	defer syscall.Close(fd)
 	_, opErr := syscall.Write(fd, ipPkg.ToRaw())
 	if opErr == syscall.EAGAIN {
 		log.Print(opErr)
 	}
 
 }
+
+func TestBindErrorResponse(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	serveConn(t, udpConn, Config{LogMessages: true})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := req.ToRaw()
+	truncated = append(truncated, 0x00, 0x03, 0x00, 0x04, 0x00)
+	signed := req.AddIntegrityAttrAnd2Raw([]byte("key"))
+	unknown := req.ToRaw()
+	unknown = append(unknown, 0x7f, 0x00, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04)
+	unknown[3] += 8
+
+	tests := []struct {
+		name string
+		raw  []byte
+		code stun.ErrorCode
+	}{
+		{"malformed", truncated, stun.CodeBadRequest},
+		{"missing username", signed, stun.CodeMissingUsername},
+		{"unknown attribute", unknown, stun.CodeUnknownAttribute},
+	}
+	buf := make([]byte, 1500)
+	for _, test := range tests {
+		conn.Write(test.raw)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if m.MessageType() != stun.BindErrorResp {
+			t.Fatalf("%s: got %s", test.name, stun.MessageTypeName(m.MessageType()))
+		}
+		if m.TransactionId() != req.(stun.OutMessage).TransactionId() {
+			t.Fatalf("%s: transaction id mismatch", test.name)
+		}
+		if code, _, _ := m.ErrorCode(); code != test.code {
+			t.Fatalf("%s: got error code %d, want %d", test.name, code, test.code)
+		}
+		if test.code == stun.CodeUnknownAttribute {
+			attrTypes, _ := m.UnknownAttributes()
+			if len(attrTypes) != 2 || attrTypes[0] != 0x7f00 {
+				t.Fatalf("%s: got unknown attributes %v", test.name, attrTypes)
+			}
+		}
+	}
+}
+
+func TestSecretIssuer(t *testing.T) {
+	now := time.Now()
+	s, err := newSecretIssuer(nil, defaultCredentialLifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	username, password, err := s.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := s.verify(username); !ok || p != password {
+		t.Fatalf("issued username rejected")
+	}
+	other, err := newSecretIssuer(nil, defaultCredentialLifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.verify(username); ok {
+		t.Fatal("username accepted under another key")
+	}
+	key := []byte("a key shared by two servers")
+	first, err := New(Config{SharedSecretKey: key, NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := New(Config{SharedSecretKey: key, NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, password, err := first.secrets.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := second.secrets.verify(shared); !ok || p != password {
+		t.Fatal("username rejected by a server with the same key")
+	}
+	tampered := []byte(username)
+	tampered[0] ^= 0x01
+	if _, ok := s.verify(string(tampered)); ok {
+		t.Fatal("tampered username accepted")
+	}
+	now = now.Add(defaultCredentialLifetime + time.Second)
+	if _, ok := s.verify(username); ok {
+		t.Fatal("expired username accepted")
+	}
+}
+
+func TestAuthBindReq(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	s := serveConn(t, udpConn, Config{LogMessages: true})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	username, password, err := s.secrets.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := stun.NewAuthBindRequest(nil, "", false, false, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		raw  []byte
+		code stun.ErrorCode
+	}{
+		{"wrong password", req.AddIntegrityAttrAnd2Raw([]byte("wrong")), stun.CodeIntegrityCheckFailure},
+		{"authenticated", req.AddIntegrityAttrAnd2Raw([]byte(password)), 0},
+	}
+	buf := make([]byte, 1500)
+	for _, test := range tests {
+		conn.Write(test.raw)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.code != 0 {
+			if code, _, _ := m.ErrorCode(); code != test.code {
+				t.Fatalf("%s: got error code %d, want %d", test.name, code, test.code)
+			}
+			continue
+		}
+		if m.MessageType() != stun.BindResp {
+			t.Fatalf("%s: got %s", test.name, stun.MessageTypeName(m.MessageType()))
+		}
+		if err := m.VerifyIntegrity([]byte(password)); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestResponseAddress(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	s := serveConn(t, udpConn, Config{LogMessages: true})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	buf := make([]byte, 1500)
+
+	req, err := stun.NewBindRequest(nil, target.LocalAddr().String(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req.ToRaw())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := stun.ToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := m.ErrorCode(); code != stun.CodeUnauthorized {
+		t.Fatalf("unauthenticated response address got error code %d", code)
+	}
+
+	username, password, err := s.secrets.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = stun.NewAuthBindRequest(nil, target.LocalAddr().String(), false, false, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req.AddIntegrityAttrAnd2Raw([]byte(password)))
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = target.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = stun.ToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MessageType() != stun.BindResp {
+		t.Fatalf("got %s", stun.MessageTypeName(m.MessageType()))
+	}
+	if reflectedFrom, _ := m.ReflectedFrom(); reflectedFrom.String() != conn.LocalAddr().String() {
+		t.Fatalf("got reflected from %v, want %s", reflectedFrom, conn.LocalAddr())
+	}
+}
+
+func TestRFC5389BindReq(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	serveConn(t, udpConn, Config{LogMessages: true})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for _, traId := range [][16]byte{stun.NewTransactionID(), stun.NewRFC5389TransactionID()} {
+		req, err := stun.NewBindRequest(traId[:], "", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(req.ToRaw())
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		modern := req.(stun.OutMessage).IsRFC5389()
+		if m.IsRFC5389() != modern {
+			t.Fatalf("answered a rfc5389=%v request with rfc5389=%v", modern, m.IsRFC5389())
+		}
+		xorMapped, xored := m.XorMappedAddress()
+		_, fingerprinted := m.GetAttribute(stun.AttrFingerprint)
+		if xored != modern || fingerprinted != modern {
+			t.Fatalf("rfc5389=%v response has xor mapped address %v and fingerprint %v", modern, xored, fingerprinted)
+		}
+		if xored && xorMapped.String() != conn.LocalAddr().String() {
+			t.Fatalf("got xor mapped address %v", xorMapped)
+		}
+	}
+}
+
+func TestIPv6BindReq(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer udpConn.Close()
+	serveConn(t, udpConn, Config{LogMessages: true})
+
+	conn, err := net.DialUDP("udp6", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req.ToRaw())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := stun.ToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := m.MappedAddress(); addr.String() != conn.LocalAddr().String() {
+		t.Fatalf("got mapped address %v, want %s", addr, conn.LocalAddr())
+	}
+	if addr, _ := m.SourceAddress(); addr.String() != udpConn.LocalAddr().String() {
+		t.Fatalf("got source address %v, want %s", addr, udpConn.LocalAddr())
+	}
+}
+
+func TestWildcardSocket(t *testing.T) {
+	for _, network := range []string{"udp4", "udp"} {
+		udpConn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udpConn.Close()
+		serveConn(t, udpConn, Config{NoRawSocket: true})
+		port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+		for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+			sAddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+			// a connected socket drops responses from any other address
+			conn, err := net.DialUDP("udp4", nil, sAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			req, err := stun.NewBindRequest(nil, "", false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(req.ToRaw())
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 1500)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("%s %s: %v", network, ip, err)
+			}
+			m, err := stun.ToMessage(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr, _ := m.SourceAddress(); addr.String() != sAddr.String() {
+				t.Fatalf("%s: got source address %v, want %s", network, addr, sAddr)
+			}
+		}
+	}
+}
+func TestWildcardSocketAllocs(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	s, err := New(Config{NoRawSocket: true, AdvertisedAddresses: map[string]string{"127.0.0.1": "203.0.113.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(s, udpConn)
+	if !h.pktinfo {
+		t.Skip("destination address of packets is not supported")
+	}
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udpConn.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := req.ToRaw()
+	buf, resp := make([]byte, 1500), make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	allocs := testing.AllocsPerRun(100, func() {
+		conn.Write(raw)
+		n, rAddr, err := h.readFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.handle(buf[:n], rAddr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(resp); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if h.dst != netip.AddrFrom4([4]byte{127, 0, 0, 1}) {
+		t.Fatalf("got destination %v", h.dst)
+	}
+	if allocs != 0 {
+		t.Fatalf("%v allocations per request", allocs)
+	}
+}
+func TestServeGroup(t *testing.T) {
+	conns, err := ListenGroup(netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddrPort("127.0.0.2:0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	var addrs [2][2]netip.AddrPort
+	for ip := range conns {
+		for port := range conns[ip] {
+			addrs[ip][port] = conns[ip][port].LocalAddr().(*net.UDPAddr).AddrPort()
+		}
+	}
+	if addrs[0][0].Port() != addrs[1][0].Port() || addrs[0][1].Port() != addrs[1][1].Port() ||
+		addrs[0][0].Addr() != addrs[0][1].Addr() || addrs[1][0].Addr() != addrs[1][1].Addr() {
+		t.Fatalf("listened on %v", addrs)
+	}
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeGroup(conns)
+	defer s.Shutdown(context.Background())
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf := make([]byte, 1500)
+	for _, to := range [][2]int{{0, 0}, {1, 1}, {0, 1}} {
+		for _, change := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+			req, err := stun.NewBindRequest(nil, "", change[0], change[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.WriteToUDPAddrPort(req.ToRaw(), addrs[to[0]][to[1]])
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := client.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				t.Fatalf("to %v change %v: %v", to, change, err)
+			}
+			m, err := stun.ToMessage(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip, port := to[0]^index(change[0]), to[1]^index(change[1])
+			source, _ := m.SourceAddress()
+			changed, _ := m.ChangedAddress()
+			mapped, _ := m.MappedAddress()
+			if from != addrs[ip][port] || source.AddrPort() != from {
+				t.Errorf("to %v change %v: answered from %v with source address %v", to, change, from, source)
+			}
+			if changed.AddrPort() != addrs[to[0]^1][to[1]^1] {
+				t.Errorf("to %v change %v: changed address %v", to, change, changed)
+			}
+			if mapped.String() != client.LocalAddr().String() {
+				t.Errorf("to %v change %v: mapped address %v", to, change, mapped)
+			}
+		}
+	}
+
+	if _, err := ListenGroup(addrs[0][0], netip.AddrPortFrom(addrs[0][0].Addr(), 1)); err == nil {
+		t.Error("listened with the same primary and alternate ip")
+	}
+}
+
+func TestAdvertisedAddresses(t *testing.T) {
+	conns, err := ListenGroup(netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddrPort("127.0.0.2:0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	var addrs [2][2]netip.AddrPort
+	for ip := range conns {
+		for port := range conns[ip] {
+			addrs[ip][port] = conns[ip][port].LocalAddr().(*net.UDPAddr).AddrPort()
+		}
+	}
+	s, err := New(Config{
+		PublicAddress:          "203.0.113.1",
+		AlternatePublicAddress: "203.0.113.2",
+		AdvertisedAddresses:    map[string]string{addrs[1][1].String(): "198.51.100.7:4000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeGroup(conns)
+	defer s.Shutdown(context.Background())
+	var public [2][2]netip.AddrPort
+	for ip, addr := range []string{"203.0.113.1", "203.0.113.2"} {
+		for port := range addrs[ip] {
+			public[ip][port] = netip.AddrPortFrom(netip.MustParseAddr(addr), addrs[ip][port].Port())
+		}
+	}
+	public[1][1] = netip.MustParseAddrPort("198.51.100.7:4000")
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf := make([]byte, 1500)
+	for _, to := range [][2]int{{0, 0}, {1, 0}} {
+		for _, change := range [][2]bool{{false, false}, {true, true}} {
+			req, err := stun.NewBindRequest(nil, "", change[0], change[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.WriteToUDPAddrPort(req.ToRaw(), addrs[to[0]][to[1]])
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := client.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				t.Fatalf("to %v change %v: %v", to, change, err)
+			}
+			m, err := stun.ToMessage(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip, port := to[0]^index(change[0]), to[1]^index(change[1])
+			source, _ := m.SourceAddress()
+			changed, _ := m.ChangedAddress()
+			if from != addrs[ip][port] || source.AddrPort() != public[ip][port] {
+				t.Errorf("to %v change %v: answered from %v with source address %v", to, change, from, source)
+			}
+			if changed.AddrPort() != public[to[0]^1][to[1]^1] {
+				t.Errorf("to %v change %v: changed address %v", to, change, changed)
+			}
+		}
+	}
+
+	for _, config := range []Config{
+		{PublicAddress: "203.0.113.1:3478"},
+		{AdvertisedAddresses: map[string]string{"10.0.0.5": "public"}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%+v: no error", config)
+		}
+	}
+}
+func TestNoRawSocket(t *testing.T) {
+	s, err := New(Config{NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lone)
+	// the two ports of 127.0.0.1, ListenAndServe's fallback without an
+	// alternate address
+	conns, err := ListenGroup(netip.MustParseAddrPort("127.0.0.1:0"), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conns[1][0] != nil || conns[1][1] != nil || conns[0][1] == nil {
+		t.Fatalf("listened on %v", conns)
+	}
+	go s.ServeGroup(conns)
+	defer s.Shutdown(context.Background())
+	if report := newHandler(s, lone).capabilities(); strings.Count(report, "unsupported") != 3 {
+		t.Errorf("lone socket reports %q", report)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	loneAddr := lone.LocalAddr().(*net.UDPAddr).AddrPort()
+	primary := conns[0][0].LocalAddr().(*net.UDPAddr).AddrPort()
+	otherPort := conns[0][1].LocalAddr().(*net.UDPAddr).AddrPort()
+	tests := []struct {
+		name                 string
+		to                   netip.AddrPort
+		changeIp, changePort bool
+		from, changed        netip.AddrPort // from is zero when the request is not supported
+	}{
+		{"lone", loneAddr, false, false, loneAddr, loneAddr},
+		{"lone change port", loneAddr, false, true, netip.AddrPort{}, loneAddr},
+		{"group", primary, false, false, primary, otherPort},
+		{"group change port", primary, false, true, otherPort, otherPort},
+		{"group change ip", primary, true, false, netip.AddrPort{}, otherPort},
+	}
+	buf := make([]byte, 1500)
+	for _, test := range tests {
+		req, err := stun.NewBindRequest(nil, "", test.changeIp, test.changePort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.WriteToUDPAddrPort(req.ToRaw(), test.to)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := client.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		m, err := stun.ToMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.from.IsValid() {
+			attrTypes, _ := m.UnknownAttributes()
+			if m.MessageType() != stun.BindErrorResp || len(attrTypes) == 0 || attrTypes[0] != stun.AttrChangeRequest {
+				t.Errorf("%s: got %s", test.name, m.ToString())
+			}
+			continue
+		}
+		changed, _ := m.ChangedAddress()
+		if from != test.from || changed.AddrPort() != test.changed {
+			t.Errorf("%s: answered from %v with changed address %v", test.name, from, changed)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stun.pcap")
+	recorder, err := pcap.NewRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serveConn(t, udpConn, Config{Recorder: recorder})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the response to a CHANGE-REQUEST is sent from another port through a
+	// raw socket, which needs CAP_NET_RAW
+	changePort := s.sender != nil
+	buf := make([]byte, 1500)
+	for _, change := range []bool{false, changePort, false} {
+		req, err := stun.NewBindRequest(nil, "", false, change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(req.ToRaw())
+		if change {
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Shutdown(context.Background())
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := pcap.Analyze(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Transactions) != 3 {
+		t.Fatalf("recorded %d transactions", len(report.Transactions))
+	}
+	for _, tr := range report.Transactions {
+		if !tr.Answered() || tr.Client.String() != conn.LocalAddr().String() || tr.MappedAddress != conn.LocalAddr().String() {
+			t.Errorf("recorded %+v", tr)
+		}
+	}
+}
+
+func TestSlowPath(t *testing.T) {
+	lone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serveConn(t, lone, Config{})
+	if s.sender == nil {
+		t.Skip("no raw socket")
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req, err := stun.NewBindRequest(nil, "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loneAddr := lone.LocalAddr().(*net.UDPAddr).AddrPort()
+	client.WriteToUDPAddrPort(req.ToRaw(), loneAddr)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := client.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := stun.ToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _ := m.SourceAddress()
+	if want := netip.AddrPortFrom(loneAddr.Addr(), loneAddr.Port()+1); from != want || source.AddrPort() != want {
+		t.Errorf("answered from %v with source address %v, want %v", from, source, want)
+	}
+
+	// without workers the queue fills up
+	s, err = New(Config{SlowPathQueue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	h := newHandler(s, lone)
+	h.addrs[0][1] = netip.AddrPortFrom(loneAddr.Addr(), loneAddr.Port()+1)
+	rAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	if err := h.handle(req.ToRaw(), rAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.handle(req.ToRaw(), rAddr); err == nil || !strings.Contains(err.Error(), "queue full") {
+		t.Fatalf("got %v with a full queue", err)
+	}
+}
+
+// fakeSender hands the datagrams the server spoofs to the test.
+type fakeSender struct {
+	datagrams chan spoofed
+	closed    bool
+}
+
+func (f *fakeSender) SendUDP(src, dst netip.AddrPort, payload []byte) error {
+	f.datagrams <- spoofed{src: src, dst: dst, payload: append([]byte(nil), payload...)}
+	return nil
+}
+func (f *fakeSender) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestDerivedAlternate(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1:3478":      "127.0.0.2:3479",
+		"192.0.2.254:65535":   "192.0.2.1:1",
+		"[::ffff:10.0.0.9]:1": "10.0.0.10:2",
+		"[2001:db8::1]:3478":  "[2001:db8::1]:3479",
+	} {
+		if got := derivedAlternate(netip.MustParseAddrPort(addr)); got.String() != want {
+			t.Errorf("alternate of %s is %v, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestRawSender(t *testing.T) {
+	lone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &fakeSender{datagrams: make(chan spoofed, 1)}
+	s, err := New(Config{RawSender: sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lone)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req, err := stun.NewBindRequest(nil, "", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loneAddr := lone.LocalAddr().(*net.UDPAddr).AddrPort()
+	client.WriteToUDPAddrPort(req.ToRaw(), loneAddr)
+	select {
+	case resp := <-sender.datagrams:
+		m, err := stun.ToMessage(resp.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, _ := m.SourceAddress()
+		want := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), loneAddr.Port()+1)
+		if resp.src != want || source.AddrPort() != want || resp.dst.String() != client.LocalAddr().String() {
+			t.Errorf("spoofed %s from %v to %v", m.ToString(), resp.src, resp.dst)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no response spoofed")
+	}
+	s.Shutdown(context.Background())
+	if sender.closed {
+		t.Error("server closed the sender of its config")
+	}
+}
+func TestReaders(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("no SO_REUSEPORT")
+	}
+	lc := reusePortConfig()
+	group, err := listenGroupConfig(lc, netip.MustParseAddrPort("127.0.0.1:0"), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	go s.ServeGroup(group)
+	for i := 1; i < 4; i++ {
+		readers, err := listenGroupCopy(lc, group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ip := range group {
+			for port := range group[ip] {
+				if (group[ip][port] == nil) != (readers[ip][port] == nil) ||
+					group[ip][port] != nil && addrPort(group[ip][port].LocalAddr()) != addrPort(readers[ip][port].LocalAddr()) {
+					t.Fatalf("listened on %v, then on %v", group, readers)
+				}
+			}
+		}
+		go s.ServeGroup(readers)
+	}
+
+	// the kernel spreads the clients over the readers, all are answered
+	to := addrPort(group[0][0].LocalAddr())
+	req, err := stun.NewBindRequest(nil, "", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	for i := 0; i < 32; i++ {
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.WriteToUDPAddrPort(req.ToRaw(), to)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := client.ReadFromUDPAddrPort(buf)
+		client.Close()
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if from != addrPort(group[0][1].LocalAddr()) {
+			t.Fatalf("client %d answered from %v", i, from)
+		}
+	}
+}
+func TestBatch(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "0.0.0.0:0"} {
+		udpConn, err := net.ListenPacket("udp4", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := serveConn(t, udpConn, Config{NoRawSocket: true, BatchSize: 4})
+		if h := baseHandler(s, udpConn); h.batch == nil {
+			t.Skip("no batched packet i/o")
+		}
+		// more clients than the batch holds, each sending before reading
+		to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), addrPort(udpConn.LocalAddr()).Port())
+		if address == "0.0.0.0:0" {
+			to = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), to.Port())
+		}
+		var clients []*net.UDPConn
+		var traIds [][16]byte
+		for i := 0; i < 6; i++ {
+			client, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			clients = append(clients, client)
+			for j := 0; j < 3; j++ {
+				traId := stun.NewRFC5389TransactionID()
+				req, err := stun.NewBindRequest(traId[:], "", false, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.Write(req.ToRaw())
+				traIds = append(traIds, traId)
+			}
+		}
+		buf := make([]byte, 1500)
+		for i, client := range clients {
+			for j := 0; j < 3; j++ {
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := client.Read(buf)
+				if err != nil {
+					t.Fatalf("%s: client %d response %d: %v", address, i, j, err)
+				}
+				m, err := stun.ToMessage(buf[:n])
+				if err != nil {
+					t.Fatal(err)
+				}
+				mapped, _ := m.MappedAddress()
+				source, _ := m.SourceAddress()
+				if m.TransactionId() != traIds[i*3+j] || mapped.String() != client.LocalAddr().String() || source.AddrPort() != to {
+					t.Errorf("%s: client %d response %d: %s", address, i, j, m.ToString())
+				}
+			}
+		}
+	}
+}
+func TestBatchFlush(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	b, err := newBatch(udpConn, 4, 0, true)
+	if err != nil {
+		t.Skip(err)
+	}
+	target, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	src, dst := udpConn.LocalAddr().(*net.UDPAddr).AddrPort(), target.LocalAddr().(*net.UDPAddr).AddrPort()
+	// the kernel rejects port 0
+	b.queue([]byte("lost"), src, netip.AddrPortFrom(dst.Addr(), 0), nil)
+	b.queue([]byte("sent"), src, dst, nil)
+	var sent []string
+	err = b.flush(func(p []byte, from, to netip.AddrPort) {
+		sent = append(sent, fmt.Sprintf("%s %s %s", p, from, to))
+	})
+	if err == nil {
+		t.Error("flushed a datagram to port 0")
+	}
+	if want := fmt.Sprintf("sent %s %s", src, dst); len(sent) != 1 || sent[0] != want {
+		t.Fatalf("got %q, want %q", sent, want)
+	}
+}
+func TestBatchAllocs(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	s, err := New(Config{NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(s, udpConn)
+	if h.batch == nil {
+		t.Skip("no batched packet i/o")
+	}
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, err := stun.NewBindRequest(nil, "", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := req.ToRaw()
+	buf, resp := make([]byte, 1500), make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	allocs := testing.AllocsPerRun(100, func() {
+		for i := 0; i < 4; i++ {
+			conn.Write(raw)
+		}
+		if err := h.serveOnce(buf); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if _, err := conn.Read(resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per batch", allocs)
+	}
+}
+func TestHandleBindReqAllocs(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	s, err := New(Config{NoRawSocket: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(s, udpConn)
+	for _, traId := range [][16]byte{stun.NewTransactionID(), stun.NewRFC5389TransactionID()} {
+		req, err := stun.NewBindRequest(traId[:], "", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := req.ToRaw()
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := h.handle(raw, rAddr); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%v allocations per request", allocs)
+		}
+	}
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := stun.ToMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := m.MappedAddress(); addr.String() != client.LocalAddr().String() {
+		t.Fatalf("got mapped address %v, want %s", addr, client.LocalAddr())
+	}
+}
+
+func BenchmarkServe(b *testing.B) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer udpConn.Close()
+	serveConn(b, udpConn, Config{})
+
+	conn, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	traId := stun.NewRFC5389TransactionID()
+	req, err := stun.NewBindRequest(traId[:], "", false, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := req.ToRaw()
+	buf := make([]byte, 1500)
+	var m stun.Message
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(raw); err != nil {
+			b.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := m.Decode(buf[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkServeReaders measures the throughput of a server reading an
+// address with several sockets, each client waiting for its response before
+// sending the next request. It only scales with as many cores as readers.
+func BenchmarkServeReaders(b *testing.B) {
+	if !reusePortSupported {
+		b.Skip("no SO_REUSEPORT")
+	}
+	traId := stun.NewRFC5389TransactionID()
+	req, err := stun.NewBindRequest(traId[:], "", false, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := req.ToRaw()
+	for _, readers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			s, err := New(Config{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Shutdown(context.Background())
+			lc := reusePortConfig()
+			address := "127.0.0.1:0"
+			for i := 0; i < readers; i++ {
+				conn, err := lc.ListenPacket(context.Background(), "udp", address)
+				if err != nil {
+					b.Fatal(err)
+				}
+				address = conn.LocalAddr().String()
+				go s.Serve(conn)
+			}
+			to, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetParallelism(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.DialUDP("udp", nil, to)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				buf := make([]byte, 1500)
+				for pb.Next() {
+					conn.Write(raw)
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					// a response lost to a full socket buffer only costs the
+					// deadline
+					conn.Read(buf)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkServeBatch compares reading and writing datagrams one by one with
+// batching them. The client sends and reads bursts with one syscall each, so
+// that the server dominates. An op is a request answered.
+func BenchmarkServeBatch(b *testing.B) {
+	traId := stun.NewRFC5389TransactionID()
+	req, err := stun.NewBindRequest(traId[:], "", false, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	raw := req.ToRaw()
+	for _, size := range []int{1, defaultBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer udpConn.Close()
+			s, err := New(Config{NoRawSocket: true, BatchSize: size})
+			if err != nil {
+				b.Fatal(err)
+			}
+			h := newHandler(s, udpConn)
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			burst, err := newBatch(client, defaultBatchSize, 0, true)
+			if err != nil {
+				b.Skip(err)
+			}
+			to := addrPort(udpConn.LocalAddr())
+			buf := make([]byte, 1500)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i += defaultBatchSize {
+				for burst.queue(raw, netip.AddrPort{}, to, nil) {
+				}
+				if err := burst.flush(nil); err != nil {
+					b.Fatal(err)
+				}
+				for pending := defaultBatchSize; pending > 0; {
+					// one by one every request takes a read, loopback
+					// delivers the burst at once
+					reads := 1
+					if h.batch == nil {
+						reads = pending
+					}
+					for ; reads > 0; reads-- {
+						if err := h.serveOnce(buf); err != nil {
+							b.Fatal(err)
+						}
+					}
+					n, err := burst.read()
+					if err != nil {
+						b.Fatal(err)
+					}
+					pending -= n
+				}
+			}
+		})
+	}
+}
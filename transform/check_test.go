@@ -1,10 +1,14 @@
 package transform
 
 import (
+	"bytes"
 	"fmt"
 	. "net"
+	"net/netip"
 	"stun/util"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewUdpPackage(t *testing.T) {
@@ -13,4 +17,137 @@ func TestNewUdpPackage(t *testing.T) {
 	udpPck,_:=NewUdpPackage(util.Ip2l(srcIp),util.Ip2l(dstIp),uint16(1087),uint16(13),[]byte{0x54,0x45,0x53,0x54,0x49,0x4e,0x47})
 	raw := udpPck.ToRaw()
 	fmt.Printf("% 32b",raw)
-}
\ No newline at end of file
+}
+func TestAppendUDPPacket(t *testing.T) {
+	src, dst := netip.MustParseAddrPort("153.19.8.104:1087"), netip.MustParseAddrPort("171.3.14.11:13")
+	for _, payload := range [][]byte{[]byte("TESTING"), []byte("TEST")} {
+		udpPkg, _ := NewUdpPackage(util.Ip2l(src.Addr().AsSlice()), util.Ip2l(dst.Addr().AsSlice()), src.Port(), dst.Port(), payload)
+		ipPkg, _ := NewIpPackage(util.Ip2l(src.Addr().AsSlice()), util.Ip2l(dst.Addr().AsSlice()), udpPkg.ToRaw())
+		packet, err := appendUDPPacket([]byte{0xff}, src, dst, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the old builder has a fixed id
+		want := ipPkg.ToRaw()
+		copy(want[4:6], packet[5:7])
+		want[10], want[11] = 0, 0
+		sum := ipCheckSum(want[:20])
+		want[10], want[11] = byte(sum>>8), byte(sum)
+		if !bytes.Equal(packet[1:], want) {
+			t.Errorf("got packet %x, want %x", packet[1:], want)
+		}
+	}
+	first, _ := appendUDPPacket(nil, src, dst, nil)
+	second, _ := appendUDPPacket(nil, src, dst, nil)
+	if bytes.Equal(first[4:6], second[4:6]) {
+		t.Errorf("packets share the id %x", first[4:6])
+	}
+	if _, err := appendUDPPacket(nil, netip.MustParseAddrPort("[::1]:1"), dst, nil); err == nil {
+		t.Error("built an ipv6 packet")
+	}
+}
+
+func TestRawSender(t *testing.T) {
+	sender, err := NewRawSender()
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := ListenUDP("udp4", &UDPAddr{IP: IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src, dst := netip.MustParseAddrPort("127.0.0.5:3478"), conn.LocalAddr().(*UDPAddr).AddrPort()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 8; j++ {
+				if err := sender.SendUDP(src, dst, []byte("spoofed")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	buf := make([]byte, 1500)
+	for i := 0; i < 32; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		if from != src || string(buf[:n]) != "spoofed" {
+			t.Fatalf("got %q from %v", buf[:n], from)
+		}
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.SendUDP(src, dst, nil); err != ErrSenderClosed {
+		t.Errorf("sent after close: %v", err)
+	}
+	if err := sender.Close(); err != ErrSenderClosed {
+		t.Errorf("closed twice: %v", err)
+	}
+}
+
+// fakeSender keeps the datagrams sent through it in memory.
+type fakeSender struct {
+	mu        sync.Mutex
+	datagrams [][3]string // source, destination and payload
+	closed    bool
+}
+
+func (f *fakeSender) SendUDP(src, dst netip.AddrPort, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.datagrams = append(f.datagrams, [3]string{src.String(), dst.String(), string(payload)})
+	return nil
+}
+func (f *fakeSender) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func TestP2pConnSender(t *testing.T) {
+	udpConn, err := ListenUDP("udp4", &UDPAddr{IP: IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &fakeSender{}
+	c := &P2pConn{
+		lAddr:   *udpConn.LocalAddr().(*UDPAddr),
+		rAddr:   UDPAddr{IP: IPv4(198, 51, 100, 2).To4(), Port: 40000},
+		sAddr:   UDPAddr{IP: IPv4(203, 0, 113, 1).To4(), Port: 3478},
+		udpConn: udpConn,
+		sender:  sender,
+	}
+	if n, err := c.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := [3]string{"203.0.113.1:3478", "198.51.100.2:40000", "hello"}
+	if len(sender.datagrams) != 1 || sender.datagrams[0] != want || sender.closed {
+		t.Errorf("sent %v, closed %v", sender.datagrams, sender.closed)
+	}
+}
+
+func TestSharedSender(t *testing.T) {
+	sender := &fakeSender{}
+	SetSender(sender)
+	defer SetSender(nil)
+	for i := 0; i < 2; i++ {
+		if got, err := SharedSender(); got != sender || err != nil {
+			t.Fatalf("shared sender %v, %v", got, err)
+		}
+	}
+	if openSender() != sender {
+		t.Error("p2p connections do not share the sender")
+	}
+}
@@ -0,0 +1,112 @@
+package transform
+
+import (
+	"errors"
+	"net/netip"
+	"stun/internal/packet"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Sender sends UDP datagrams from any address, not only those of the host,
+// like the responses of a STUN server to a CHANGE-REQUEST.
+type Sender interface {
+	SendUDP(src, dst netip.AddrPort, payload []byte) error
+	Close() error
+}
+
+// ErrSenderClosed is returned by SendUDP after Close.
+var ErrSenderClosed = errors.New("transform: sender closed")
+
+var (
+	sharedMu sync.Mutex
+	shared   Sender
+)
+
+// SharedSender returns the Sender of the process, used by P2pConn and the
+// STUN server: the one set with SetSender, or a RawSender opened on first
+// use and kept open. It fails without the privilege to open a raw socket.
+func SharedSender() (Sender, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if shared == nil {
+		sender, err := NewRawSender()
+		if err != nil {
+			return nil, err
+		}
+		shared = sender
+	}
+	return shared, nil
+}
+
+// SetSender makes SharedSender return s, such as an in-memory fake in tests.
+// The sender it replaces is not closed.
+func SetSender(s Sender) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	shared = s
+}
+
+// packetId is the IP id of the last packet built, each gets its own so that
+// fragments of different packets are not reassembled together.
+var packetId uint32
+
+// RawSender sends IPv4 UDP datagrams through a raw IP socket, which takes
+// CAP_NET_RAW. It is safe for concurrent use, each packet is built in a
+// buffer kept between sends.
+type RawSender struct {
+	mu     sync.Mutex
+	fd     int
+	closed bool
+	buf    []byte
+}
+
+// NewRawSender opens the raw IP socket of a RawSender, to be closed with
+// Close.
+func NewRawSender() (*RawSender, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	return &RawSender{fd: fd, buf: make([]byte, 0, 1500)}, nil
+}
+
+// SendUDP sends payload from src to dst, both IPv4 addresses.
+func (s *RawSender) SendUDP(src, dst netip.AddrPort, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSenderClosed
+	}
+	var err error
+	s.buf, err = appendUDPPacket(s.buf[:0], src, dst, payload)
+	if err != nil {
+		return err
+	}
+	return syscall.Sendto(s.fd, s.buf, 0, &syscall.SockaddrInet4{Addr: dst.Addr().Unmap().As4()})
+}
+
+// Close closes the socket, sends after it fail with ErrSenderClosed.
+func (s *RawSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSenderClosed
+	}
+	s.closed = true
+	return syscall.Close(s.fd)
+}
+
+// appendUDPPacket appends the IPv4 packet carrying payload from src to dst
+// to b.
+func appendUDPPacket(b []byte, src, dst netip.AddrPort, payload []byte) ([]byte, error) {
+	srcIp, dstIp := src.Addr().Unmap(), dst.Addr().Unmap()
+	if !srcIp.Is4() || !dstIp.Is4() {
+		return b, errors.New("raw packets are only sent over ipv4")
+	}
+	if fixedIpHeaderLength+udpHeaderLength+len(payload) > 0xffff {
+		return b, errors.New("payload too large for an ipv4 packet")
+	}
+	return packet.AppendUDP(b, src, dst, payload, uint16(atomic.AddUint32(&packetId, 1)), ttl), nil
+}
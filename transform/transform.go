@@ -7,7 +7,6 @@ import (
 	"math"
 	"net"
 	"stun"
-	"stun/util"
 	"syscall"
 	"time"
 )
@@ -143,13 +142,16 @@ func NewUdpPackage(srcAddr, dstAddr uint32, srcPort, dstPort uint16, data []byte
 	return &u, nil
 }
 
+// P2pConn sends packets that look like they come from the STUN server, so
+// that they get through a NAT the server punched a hole in. Without raw IP
+// sockets it sends them from its own socket instead.
 type P2pConn struct {
 	lAddr   net.UDPAddr
 	rAddr   net.UDPAddr
 	sAddr   net.UDPAddr
 	nAddr   net.UDPAddr
 	udpConn *net.UDPConn
-	fd      int
+	sender  Sender // the SharedSender, nil if raw IP sockets are unavailable
 }
 
 func hole(lAddr, rAddr *net.UDPAddr) (string, error) {
@@ -159,7 +161,7 @@ func hole(lAddr, rAddr *net.UDPAddr) (string, error) {
 	}
 	defer conn.Close()
 	id := stun.NewTransactionID()
-	request, err := stun.NewBindRequest(id[:], lAddr.String(), false, false)
+	request, err := stun.NewBindRequest(id[:], "", false, false)
 	if err != nil {
 		return "", err
 	}
@@ -179,8 +181,11 @@ func hole(lAddr, rAddr *net.UDPAddr) (string, error) {
 			switch m.MessageType() {
 			case stun.BindResp:
 				log.Printf("receive message for hole from server,%v", m.ToString())
-				av := m.GetAttribute(stun.AttrMappedAddress)
-				return av.(string), nil
+				mappedAddress, ok := m.MappedAddress()
+				if !ok {
+					return "", errors.New("no mapped address")
+				}
+				return mappedAddress.String(), nil
 			default:
 				return "", errors.New("hole failed")
 			}
@@ -206,15 +211,10 @@ func DialP2p(laddr, raddr, saddr net.Addr) (p2pConn *P2pConn, err error) {
 		return nil, err
 	}
 	nAddr, err := net.ResolveUDPAddr("udp", naddr)
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			syscall.Shutdown(fd, syscall.SHUT_RDWR)
-		}
-	}()
+	sender := openSender()
 	udpConn, err := net.ListenUDP("udp", lAddr)
 	if err != nil {
 		return nil, err
@@ -234,7 +234,7 @@ func DialP2p(laddr, raddr, saddr net.Addr) (p2pConn *P2pConn, err error) {
 		sAddr:   *sAddr,
 		nAddr:   *nAddr,
 		udpConn: udpConn,
-		fd:      fd,
+		sender:  sender,
 	}
 	// 测试对端
 	id := stun.NewTransactionID()
@@ -268,10 +268,7 @@ func ListenP2p(laddr, saddr net.Addr) (*P2pConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
-	if err != nil {
-		return nil, err
-	}
+	sender := openSender()
 	udpConn, err := net.ListenUDP("udp", lAddr)
 	if err != nil {
 		return nil, err
@@ -281,21 +278,32 @@ func ListenP2p(laddr, saddr net.Addr) (*P2pConn, error) {
 		sAddr:   *sAddr,
 		nAddr:   *nAddr,
 		udpConn: udpConn,
-		fd:      fd,
+		sender:  sender,
 	}
 	return conn, nil
 }
+
+// openSender returns the SharedSender, or nil without the privilege to open
+// a raw socket.
+func openSender() Sender {
+	sender, err := SharedSender()
+	if err != nil {
+		log.Printf("no raw socket, sending from the local address,%v", err)
+		return nil
+	}
+	return sender
+}
 func (c *P2pConn) ok() bool {
-	return c != nil && c.udpConn != nil && c.fd != 0 && c.rAddr.IP != nil
+	return c != nil && c.udpConn != nil && c.rAddr.IP != nil
 }
 func (c *P2pConn) readOk() bool {
-	return c != nil && c.udpConn != nil && c.fd != 0
+	return c != nil && c.udpConn != nil
 }
 func (c *P2pConn) NatAddr() *net.UDPAddr {
 	return &c.nAddr
 }
 
-//Read implements the Conn Read method.
+// Read implements the Conn Read method.
 func (c *P2pConn) Read(b []byte) (int, error) {
 	if !c.readOk() {
 		return 0, syscall.EINVAL
@@ -319,10 +327,9 @@ func (c *P2pConn) setRAddr(byte []byte) error {
 	}
 	if stun.BindReq == m.MessageType() {
 		log.Printf("receive message for hole from endpoint,%v", m.ToString())
-		av := m.GetAttribute(stun.AttrResponseAddress)
-		addr, err := net.ResolveUDPAddr("udp", av.(string))
-		if err != nil {
-			return err
+		addr, ok := m.ResponseAddress()
+		if !ok {
+			return errors.New("no response address")
 		}
 		c.rAddr = *addr
 		return nil
@@ -336,21 +343,13 @@ func (c *P2pConn) Write(b []byte) (int, error) {
 	if !c.ok() {
 		return 0, syscall.EINVAL
 	}
-	srcIp, dstIp := util.Ip2l(c.sAddr.IP), util.Ip2l(c.rAddr.IP)
-	//log.Printf("srcIp:%v,dstIp:%v,sport:%v,dport:%v", c.sAddr.IP, c.rAddr.IP, c.sAddr.Port, c.rAddr.Port)
-	udpPkg, err := NewUdpPackage(srcIp, dstIp, uint16(c.sAddr.Port), uint16(c.rAddr.Port), b)
-	if err != nil {
-		return 0, err
+	if c.sender == nil {
+		return c.udpConn.WriteToUDP(b, &c.rAddr)
 	}
-	ipPkg, err := NewIpPackage(srcIp, dstIp, udpPkg.ToRaw())
-	if err != nil {
-		return 0, nil
+	if err := c.sender.SendUDP(c.sAddr.AddrPort(), c.rAddr.AddrPort(), b); err != nil {
+		return 0, err
 	}
-	sa := syscall.SockaddrInet4{}
-	sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3] = c.rAddr.IP[0], c.rAddr.IP[1], c.rAddr.IP[2], c.rAddr.IP[3]
-
-	err = syscall.Sendto(c.fd, ipPkg.ToRaw(), 0, &sa)
-	return len(b), err
+	return len(b), nil
 }
 
 // Close closes the connection.
@@ -358,12 +357,8 @@ func (c *P2pConn) Close() error {
 	if !c.ok() {
 		return syscall.EINVAL
 	}
-	err := c.udpConn.Close()
-	if err != nil {
-		return err
-	}
-	err = syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
-	return err
+	// the sender is shared, it stays open
+	return c.udpConn.Close()
 }
 
 // LocalAddr returns the local network address.
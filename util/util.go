@@ -23,7 +23,7 @@ func isLittleEndian() bool  {
 	bp := (*byte)(p)
 	return *bp == 0x02
 }
-func hmacSha1 (message []byte,key []byte) []byte {
+func HmacSha1(message []byte, key []byte) []byte {
 	mac := hmac.New(sha1.New, key)
 	mac.Write(message)
 	return mac.Sum(nil)